@@ -4,8 +4,6 @@ import (
 	"errors"
 	"net/http"
 	"strings"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
 type Credentials struct {
@@ -19,7 +17,9 @@ type Credentials struct {
 	DeviceType string `json:"deviceType"`
 }
 
-func CheckAuthorization(r *http.Request) (jwt.MapClaims, error) {
+// CheckAuthorization returns the claims of the token in the Authorization header, which must be
+// issued for audience, the id of the module serving the request
+func CheckAuthorization(r *http.Request, audience string) (*CustomClaims, error) {
 
 	token := r.Header.Get("Authorization")
 
@@ -29,13 +29,20 @@ func CheckAuthorization(r *http.Request) (jwt.MapClaims, error) {
 		return nil, errors.New("missing Authorization header")
 	}
 
-	claims, valid, err := DecodeJWT(token)
+	claims, err := DecodeJWT(token, audience)
 
-	if err != nil || !valid {
+	if errors.Is(err, TokenExpired) {
+		return nil, errors.New("token expired")
+	} else if err != nil {
 		return nil, errors.New("invalid token")
 	}
 
-	if claims["userId"].(string) == "" {
+	// Logged out or deleted
+	if err := checkRevoked(claims); err != nil {
+		return nil, err
+	}
+
+	if claims.UserId == "" {
 		return nil, errors.New("missing user id in token")
 	}
 
@@ -55,3 +62,7 @@ func contains(csv string, target string) bool {
 func HasPrivilege(privileges string, target string) bool {
 	return contains(privileges, target) || contains(privileges, "ek_admin")
 }
+
+func HasRole(roles string, target string) bool {
+	return contains(roles, target) || contains(roles, "ADMIN")
+}
@@ -2,8 +2,12 @@ package auth
 
 import (
 	"ekhoes-server/config"
+	"ekhoes-server/utils"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -21,29 +25,77 @@ type CustomClaims struct {
 	jwt.RegisteredClaims
 }
 
-func GenerateJWT(claims CustomClaims, expiresAt time.Time) (string, error) {
-	/*
-		claims := CustomClaims{
-			SessionId:  sessionId,
-			UserId:     userId,
-			Email:      email,
-			Name:       name,
-			Roles:      roles,
-			Privileges: privileges,
-			RegisteredClaims: jwt.RegisteredClaims{
-				IssuedAt: jwt.NewNumericDate(time.Now()),
-				Issuer:   "ekhoes-server",
-				Subject:  userId,
-			},
+// Algorithms accepted by DecodeJWT(), the key decides which one applies to a token
+var validMethods = []string{"HS256", "RS256", "ES256", "ES384", "ES512", "EdDSA"}
+
+var (
+	TokenExpired   = jwt.ErrTokenExpired
+	WrongAudience  = errors.New("token issued for another module")
+	MissingSession = errors.New("token not bound to a session")
+)
+
+// Accepted aud claims of session tokens, the ids of the loaded modules
+var (
+	audiences   []string
+	audiencesMu sync.RWMutex
+)
+
+// RegisterAudience makes VerifySessionToken() accept the tokens issued for a module
+func RegisterAudience(id string) {
+	audiencesMu.Lock()
+	defer audiencesMu.Unlock()
+
+	if !slices.Contains(audiences, id) {
+		audiences = append(audiences, id)
+	}
+}
+
+func audienceAllowed(aud jwt.ClaimStrings) bool {
+	audiencesMu.RLock()
+	defer audiencesMu.RUnlock()
+
+	for _, a := range aud {
+		if slices.Contains(audiences, a) {
+			return true
 		}
-	*/
+	}
+
+	return false
+}
+
+/**
+ * GenerateJWT signs claims, adding the registered ones: iss, sub (the user), iat, nbf and a unique jti.
+ * The audience is set by the caller, see IssueTokens().
+ */
+func GenerateJWT(claims CustomClaims, expiresAt time.Time) (string, error) {
+	now := time.Now()
+
+	claims.Issuer = config.JWTIssuer()
+	claims.Subject = claims.UserId
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.NotBefore = jwt.NewNumericDate(now)
+	claims.ID = utils.UUID()
+
 	if !expiresAt.IsZero() {
 		claims.ExpiresAt = jwt.NewNumericDate(expiresAt)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	ring, err := getKeys()
+	if err != nil {
+		return "", err
+	}
+
+	// HS256 unless a private key is configured
+	if ring.signing == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	tokenString, err := token.SignedString([]byte(config.JWTSecret()))
+		return token.SignedString([]byte(config.JWTSecret()))
+	}
+
+	token := jwt.NewWithClaims(ring.signing.method, claims)
+	token.Header["kid"] = ring.signing.kid
+
+	tokenString, err := token.SignedString(ring.signing.private)
 	if err != nil {
 		return "", err
 	}
@@ -51,56 +103,114 @@ func GenerateJWT(claims CustomClaims, expiresAt time.Time) (string, error) {
 	return tokenString, nil
 }
 
-func DecodeJWT(tokenString string) (jwt.MapClaims, bool, error) {
+/**
+ * DecodeJWT returns the claims of a valid token issued for the module audience: signature, issuer,
+ * audience, expiration, not-before and issued-at are checked, with config.JWTLeeway() of clock skew.
+ * Expired tokens give an error wrapping TokenExpired.
+ */
+func DecodeJWT(tokenString string, audience string) (*CustomClaims, error) {
+	return decodeJWT(tokenString, func(aud jwt.ClaimStrings, sessionId string) bool {
+		return slices.Contains(aud, audience)
+	})
+}
 
-	valid := true
+// The app of a session id, ses:<appId>:<ULID>
+func sessionApp(sessionId string) string {
+	parts := strings.Split(sessionId, ":")
 
-	var jwtSecret = []byte(config.JWTSecret())
+	if len(parts) != 3 {
+		return ""
+	}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("invalid sign algoritm: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
+	return parts[1]
+}
+
+// Tokens must be issued for a loaded module, and those of a session for its app only
+func sessionAudience(aud jwt.ClaimStrings, sessionId string) bool {
+	if sessionId == "" {
+		return audienceAllowed(aud)
+	}
+
+	return audienceAllowed(aud) && slices.Contains(aud, sessionApp(sessionId))
+}
+
+func decodeJWT(tokenString string, audienceValid func(aud jwt.ClaimStrings, sessionId string) bool) (*CustomClaims, error) {
+	claims := &CustomClaims{}
+
+	_, err := jwt.ParseWithClaims(tokenString, claims, verificationKey,
+		jwt.WithValidMethods(validMethods),
+		jwt.WithIssuer(config.JWTIssuer()),
+		jwt.WithLeeway(config.JWTLeeway()),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired())
 
 	if err != nil {
-		if !errors.Is(err, jwt.ErrTokenExpired) {
-			return nil, false, fmt.Errorf("invalid token: %w", err)
-		}
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+
+	if !audienceValid(claims.Audience, claims.SessionId) {
+		return nil, fmt.Errorf("invalid token: %w", WrongAudience)
+	}
+
+	return claims, nil
+}
+
+// Same as decodeJWT() with sessionAudience(), but accepting expired tokens, to log out with them
+func decodeExpiredJWT(tokenString string) (*CustomClaims, error) {
+	claims, err := decodeJWT(tokenString, sessionAudience)
+
+	if !errors.Is(err, TokenExpired) {
+		return claims, err
 	}
 
-	valid = token.Valid
+	claims = &CustomClaims{}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, valid, fmt.Errorf("invalid claims")
+	_, err = jwt.ParseWithClaims(tokenString, claims, verificationKey,
+		jwt.WithValidMethods(validMethods),
+		jwt.WithoutClaimsValidation())
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
 	}
 
-	return claims, valid, nil
+	if claims.Issuer != config.JWTIssuer() || !sessionAudience(claims.Audience, claims.SessionId) {
+		return nil, errors.New("invalid token")
+	}
+
+	return claims, nil
 }
 
 func VerifyJWT(tokenString string) (string, error) {
+	sessionId, _, err := VerifySessionToken(tokenString)
+
+	return sessionId, err
+}
 
-	claims, valid, err := DecodeJWT(tokenString)
+// VerifySessionToken returns the session id of a valid token and its expiration.
+// The token must be bound to a session and issued for its app, e.g. to open a websocket:
+// session-less tokens (admin logins with ?nosession) are refused.
+func VerifySessionToken(tokenString string) (string, time.Time, error) {
+	var expiresAt time.Time
 
-	if err != nil {
-		return "", err
+	claims, err := decodeJWT(tokenString, sessionAudience)
+
+	if errors.Is(err, TokenExpired) {
+		return "", expiresAt, fmt.Errorf("token expired")
+	} else if err != nil {
+		return "", expiresAt, err
 	}
 
-	sessionId, ok := claims["sessionId"].(string)
-	if !ok {
-		return "", fmt.Errorf("claim 'sessionId' not found or not a string")
+	if claims.SessionId == "" {
+		return "", expiresAt, MissingSession
 	}
 
-	// Check expiration
-	if !valid {
-		if expRaw, ok := claims["exp"].(float64); ok {
-			if time.Now().Unix() > int64(expRaw) {
-				return "", fmt.Errorf("token expired")
-			}
-		}
+	if err := checkRevoked(claims); err != nil {
+		return "", expiresAt, err
+	}
+
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
 	}
 
-	return sessionId, nil
+	return claims.SessionId, expiresAt, nil
 }
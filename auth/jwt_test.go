@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"ekhoes-server/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Replace the configured keys with a fresh Ed25519 signing key
+func useTestKey(t *testing.T) *jwtKey {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := &jwtKey{kid: "test", method: jwt.SigningMethodEdDSA, public: public, private: private}
+
+	keysOnce.Do(func() {})
+	keys = &keyRing{signing: key, verify: map[string]*jwtKey{key.kid: key}}
+
+	t.Setenv("EKHOES_JWT_SECRET", "")
+	t.Setenv("EKHOES_JWT_ISSUER", "")
+	t.Setenv("EKHOES_JWT_LEEWAY", "30")
+
+	return key
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims CustomClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestDecodeJWT(t *testing.T) {
+	key := useTestKey(t)
+
+	now := time.Now()
+
+	valid := func() CustomClaims {
+		return CustomClaims{
+			SessionId: "ses:hnw:01JTEST",
+			UserId:    "1000",
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "ekhoes-server",
+				Subject:   "1000",
+				Audience:  jwt.ClaimStrings{"hnw"},
+				IssuedAt:  jwt.NewNumericDate(now),
+				NotBefore: jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+				ID:        "jti",
+			},
+		}
+	}
+
+	_, otherPrivate, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name  string
+		token func() string
+		err   error // nil for a valid token
+	}{
+		{"valid", func() string {
+			return signToken(t, jwt.SigningMethodEdDSA, key.kid, key.private, valid())
+		}, nil},
+		{"expired within leeway", func() string {
+			c := valid()
+			c.ExpiresAt = jwt.NewNumericDate(now.Add(-10 * time.Second))
+			return signToken(t, jwt.SigningMethodEdDSA, key.kid, key.private, c)
+		}, nil},
+		{"wrong issuer", func() string {
+			c := valid()
+			c.Issuer = "someone-else"
+			return signToken(t, jwt.SigningMethodEdDSA, key.kid, key.private, c)
+		}, jwt.ErrTokenInvalidIssuer},
+		{"wrong audience", func() string {
+			c := valid()
+			c.Audience = jwt.ClaimStrings{"admin"}
+			return signToken(t, jwt.SigningMethodEdDSA, key.kid, key.private, c)
+		}, WrongAudience},
+		{"expired", func() string {
+			c := valid()
+			c.ExpiresAt = jwt.NewNumericDate(now.Add(-2 * time.Minute))
+			return signToken(t, jwt.SigningMethodEdDSA, key.kid, key.private, c)
+		}, TokenExpired},
+		{"without expiration", func() string {
+			c := valid()
+			c.ExpiresAt = nil
+			return signToken(t, jwt.SigningMethodEdDSA, key.kid, key.private, c)
+		}, jwt.ErrTokenRequiredClaimMissing},
+		{"not valid yet", func() string {
+			c := valid()
+			c.NotBefore = jwt.NewNumericDate(now.Add(5 * time.Minute))
+			return signToken(t, jwt.SigningMethodEdDSA, key.kid, key.private, c)
+		}, jwt.ErrTokenNotValidYet},
+		{"issued in the future", func() string {
+			c := valid()
+			c.IssuedAt = jwt.NewNumericDate(now.Add(5 * time.Minute))
+			return signToken(t, jwt.SigningMethodEdDSA, key.kid, key.private, c)
+		}, jwt.ErrTokenUsedBeforeIssued},
+		{"unknown kid", func() string {
+			return signToken(t, jwt.SigningMethodEdDSA, "other", otherPrivate, valid())
+		}, UnknownKey},
+		{"wrong key", func() string {
+			return signToken(t, jwt.SigningMethodEdDSA, key.kid, otherPrivate, valid())
+		}, jwt.ErrTokenSignatureInvalid},
+		{"HS256 with a signing key and no secret", func() string {
+			return signToken(t, jwt.SigningMethodHS256, key.kid, []byte(""), valid())
+		}, jwt.ErrTokenUnverifiable},
+		{"algorithm not accepted", func() string {
+			return signToken(t, jwt.SigningMethodHS384, key.kid, []byte(""), valid())
+		}, jwt.ErrTokenSignatureInvalid},
+		{"without session (admin ?nosession login)", func() string {
+			c := valid()
+			c.SessionId = ""
+			return signToken(t, jwt.SigningMethodEdDSA, key.kid, key.private, c)
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := DecodeJWT(tt.token(), "hnw")
+
+			if tt.err == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if claims.UserId != "1000" {
+					t.Errorf("UserId = %q, want 1000", claims.UserId)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifySessionToken(t *testing.T) {
+	key := useTestKey(t)
+	RegisterAudience("hnw")
+
+	token := func(sessionId string, audience string) string {
+		now := time.Now()
+
+		return signToken(t, jwt.SigningMethodEdDSA, key.kid, key.private, CustomClaims{
+			SessionId: sessionId,
+			UserId:    "1000",
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "ekhoes-server",
+				Audience:  jwt.ClaimStrings{audience},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+				ID:        utils.UUID(),
+			},
+		})
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"session of the audience", token("ses:hnw:01JTEST", "hnw"), nil},
+		{"without session", token("", "hnw"), MissingSession},
+		{"session of another app", token("ses:admin:01JTEST", "hnw"), WrongAudience},
+		{"module not loaded", token("ses:other:01JTEST", "other"), WrongAudience},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessionId, _, err := VerifySessionToken(tt.token)
+
+			if tt.err == nil {
+				if err != nil || sessionId == "" {
+					t.Fatalf("sessionId, err = %q, %v", sessionId, err)
+				}
+				return
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"ekhoes-server/config"
+	"ekhoes-server/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A key verifying tokens, and signing them if private is set
+type jwtKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	public  crypto.PublicKey
+	private crypto.Signer
+}
+
+type keyRing struct {
+	signing *jwtKey            // nil in HS256 mode
+	verify  map[string]*jwtKey // By kid, signing key included
+}
+
+var (
+	keys     *keyRing
+	keysErr  error
+	keysOnce sync.Once
+
+	UnknownKey = errors.New("unknown signing key")
+)
+
+/**
+ * LoadKeys reads the signing and verification keys. Called at startup, so that a bad
+ * configuration stops the server instead of failing every login.
+ */
+func LoadKeys() error {
+	keysOnce.Do(func() {
+		keys, keysErr = loadKeyRing()
+
+		if keysErr != nil {
+			return
+		}
+
+		if keys.signing == nil {
+			utils.Log("Signing tokens with HS256\n")
+		} else {
+			utils.Log("Signing tokens with %s, key %s (%d verification keys)\n", keys.signing.method.Alg(), keys.signing.kid, len(keys.verify))
+		}
+	})
+
+	return keysErr
+}
+
+func getKeys() (*keyRing, error) {
+	err := LoadKeys()
+
+	return keys, err
+}
+
+func loadKeyRing() (*keyRing, error) {
+	ring := &keyRing{verify: map[string]*jwtKey{}}
+
+	if path := config.JWTPrivateKey(); path != "" {
+		key, err := loadKeyFile(config.JWTKeyId(), path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if key.private == nil {
+			return nil, fmt.Errorf("%s: not a private key", path)
+		}
+
+		ring.signing = key
+		ring.verify[key.kid] = key
+	} else if config.JWTSecret() == "" {
+		utils.Error("Neither EKHOES_JWT_PRIVATE_KEY nor EKHOES_JWT_SECRET are set, tokens are signed with an empty secret")
+	}
+
+	for _, entry := range config.JWTVerificationKeys() {
+		kid, path := "", entry
+
+		if k, p, ok := strings.Cut(entry, "="); ok {
+			kid, path = k, p
+		}
+
+		key, err := loadKeyFile(kid, path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := ring.verify[key.kid]; ok {
+			return nil, fmt.Errorf("%s: duplicate key id %s", path, key.kid)
+		}
+
+		key.private = nil // Only verifies
+		ring.verify[key.kid] = key
+	}
+
+	return ring, nil
+}
+
+func loadKeyFile(kid string, path string) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseKey(data)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if kid == "" {
+		kid, err = thumbprint(key.public)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	key.kid = kid
+
+	return key, nil
+}
+
+// Private or public key in PEM format, PKCS#8/PKIX or the legacy PKCS#1 and SEC 1 encodings
+func parseKey(data []byte) (*jwtKey, error) {
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var (
+		parsed any
+		err    error
+	)
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	key := &jwtKey{}
+
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.private = signer
+		key.public = signer.Public()
+	} else {
+		key.public = parsed
+	}
+
+	switch pub := key.public.(type) {
+	case *rsa.PublicKey:
+		key.method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			key.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			key.method = jwt.SigningMethodES384
+		case elliptic.P521():
+			key.method = jwt.SigningMethodES512
+		default:
+			return nil, errors.New("unsupported elliptic curve")
+		}
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key.public)
+	}
+
+	return key, nil
+}
+
+// JSON Web Key, public members only
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func publicJWK(public crypto.PublicKey) (JWK, error) {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", N: b64(pub.N.Bytes()), E: b64(big.NewInt(int64(pub.E)).Bytes())}, nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return JWK{Kty: "EC", Crv: pub.Curve.Params().Name, X: b64(pub.X.FillBytes(make([]byte, size))), Y: b64(pub.Y.FillBytes(make([]byte, size)))}, nil
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: b64(pub)}, nil
+	}
+
+	return JWK{}, fmt.Errorf("unsupported key type %T", public)
+}
+
+// RFC 7638 thumbprint: SHA-256 of the required members, in lexicographic order
+func thumbprint(public crypto.PublicKey) (string, error) {
+	jwk, err := publicJWK(public)
+
+	if err != nil {
+		return "", err
+	}
+
+	var members string
+
+	switch jwk.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk.Crv, jwk.X, jwk.Y)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, jwk.Crv, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(members))
+
+	return b64(sum[:]), nil
+}
+
+/**
+ * Key for a token being parsed: asymmetric tokens are looked up by kid, HS256 ones are
+ * accepted in HS256 mode and, while migrating from it, as long as EKHOES_JWT_SECRET is set.
+ */
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	ring, err := getKeys()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if ring.signing != nil && config.JWTSecret() == "" {
+			return nil, fmt.Errorf("invalid sign algoritm: %v", token.Header["alg"])
+		}
+		return []byte(config.JWTSecret()), nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := ring.verify[kid]
+
+	if !ok {
+		return nil, UnknownKey
+	}
+
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("invalid sign algoritm: %v", token.Header["alg"])
+	}
+
+	return key.public, nil
+}
+
+/**
+ * GET /.well-known/jwks.json
+ * Public keys verifying the tokens, for other services. Empty in HS256 mode.
+ */
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	type Response struct {
+		Keys []JWK `json:"keys"`
+	}
+
+	response := Response{Keys: []JWK{}}
+
+	ring, err := getKeys()
+
+	if err != nil {
+		utils.Err(err)
+		http.Error(w, "Error loading keys", http.StatusInternalServerError)
+		return
+	}
+
+	kids := make([]string, 0, len(ring.verify))
+	for kid := range ring.verify {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	for _, kid := range kids {
+		key := ring.verify[kid]
+
+		jwk, err := publicJWK(key.public)
+
+		if err != nil {
+			utils.Err(err)
+			continue
+		}
+
+		jwk.Kid = key.kid
+		jwk.Use = "sig"
+		jwk.Alg = key.method.Alg()
+
+		response.Keys = append(response.Keys, jwk)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
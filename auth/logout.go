@@ -29,7 +29,7 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	//sessionId, err := verifyJWT(payload.Token)
-	claims, _, err := DecodeJWT(payload.Token)
+	claims, err := decodeExpiredJWT(payload.Token)
 
 	if err != nil {
 		log.Println(err)
@@ -37,18 +37,17 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionId, ok := claims["sessionId"].(string)
+	sessionId := claims.SessionId
 
-	if !ok {
-		log.Println("claim 'sessionId' not found or not a string")
-		http.Error(w, "claim 'sessionId' not found or not a string", http.StatusInternalServerError)
-		return
+	if err := RevokeToken(claims); err != nil {
+		log.Println(err)
 	}
 
 	log.Printf("Deleting session: %s\n", sessionId)
 
+	// Drop the refresh token too and close the websockets of the session
 	if sessionId != "" {
-		Delete(sessionId)
+		RevokeSession(sessionId)
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"ekhoes-server/db"
+	"ekhoes-server/utils"
+)
+
+// Argon2id parameters of new hashes. Hashes made with other parameters are upgraded on login.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 2
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+var InvalidHash = errors.New("invalid password hash")
+
+/**
+ * HashPassword returns the Argon2id hash of password in PHC string format:
+ * $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+ */
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+/**
+ * VerifyPassword checks password against the stored value, which can be an Argon2id hash,
+ * a bcrypt hash (made by pgcrypto's crypt()) or a legacy plain text password.
+ * rehash is true when the password matches but the stored value should be replaced
+ * with a new HashPassword().
+ */
+func VerifyPassword(stored string, password string) (match bool, rehash bool, err error) {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return verifyArgon2id(stored, password)
+
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, fmt.Errorf("%w: %s", InvalidHash, err.Error())
+		}
+
+		return true, true, nil
+
+	case stored == "":
+		return false, false, nil
+
+	case strings.HasPrefix(stored, "$"):
+		// A hash of an unknown or malformed format, never compared as plain text
+		return false, false, InvalidHash
+
+	default:
+		// Legacy plain text
+		match := subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+
+		return match, match, nil
+	}
+}
+
+func verifyArgon2id(stored string, password string) (bool, bool, error) {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=2", salt, key
+	parts := strings.Split(stored, "$")
+
+	if len(parts) != 6 {
+		return false, false, InvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, InvalidHash
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || memory == 0 || time == 0 || threads == 0 {
+		return false, false, InvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, InvalidHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, false, InvalidHash
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+
+	if subtle.ConstantTimeCompare(key, computed) != 1 {
+		return false, false, nil
+	}
+
+	rehash := memory != argonMemory || time != argonTime || threads != argonThreads || len(key) != argonKeyLen
+
+	return true, rehash, nil
+}
+
+/**
+ * Replace a legacy (plain text or outdated) password with a new hash, running the
+ * update_password.sql of the module owning the users table.
+ * A failure doesn't prevent the login, it's retried at the next one.
+ */
+func RehashPassword(sqlFS fs.FS, userId string, password string) {
+	hash, err := HashPassword(password)
+
+	if err != nil {
+		utils.Err(err)
+		return
+	}
+
+	if err := db.ExecuteSQL(sqlFS, "update_password.sql", hash, userId); err != nil {
+		utils.Error("Can't rehash password of user %s: %s", userId, err)
+		return
+	}
+
+	utils.Log("Password of user %s rehashed\n", userId)
+}
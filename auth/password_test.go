@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	argon, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same password, weaker parameters than the current ones
+	salt := []byte("somesalt")
+	outdated := fmt.Sprintf("$argon2id$v=%d$m=16,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), salt, 1, 16, 1, 16)))
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		match    bool
+		rehash   bool
+		err      error
+	}{
+		{"argon2id", argon, "secret", true, false, nil},
+		{"argon2id wrong password", argon, "wrong", false, false, nil},
+		{"argon2id outdated parameters", outdated, "secret", true, true, nil},
+		{"bcrypt", string(bcryptHash), "secret", true, true, nil},
+		{"bcrypt wrong password", string(bcryptHash), "wrong", false, false, nil},
+		{"plain text", "secret", "secret", true, true, nil},
+		{"plain text wrong password", "secret", "wrong", false, false, nil},
+		{"empty", "", "", false, false, nil},
+		{"bcrypt truncated", "$2a$10$short", "secret", false, false, InvalidHash},
+		{"argon2id missing parts", "$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHQ", "secret", false, false, InvalidHash},
+		{"argon2id wrong version", "$argon2id$v=16$m=65536,t=3,p=2$c29tZXNhbHQ$a2V5", "secret", false, false, InvalidHash},
+		{"argon2id bad parameters", "$argon2id$v=19$m=x,t=3,p=2$c29tZXNhbHQ$a2V5", "secret", false, false, InvalidHash},
+		{"argon2id zero parameters", "$argon2id$v=19$m=65536,t=0,p=0$c29tZXNhbHQ$a2V5", "secret", false, false, InvalidHash},
+		{"argon2id bad salt", "$argon2id$v=19$m=65536,t=3,p=2$!!!$a2V5", "secret", false, false, InvalidHash},
+		{"argon2id empty key", "$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHQ$", "secret", false, false, InvalidHash},
+		{"unknown hash", "$5$rounds=5000$salt$hash", "$5$rounds=5000$salt$hash", false, false, InvalidHash},
+		{"unknown hash equal to password", "$unknown", "$unknown", false, false, InvalidHash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, rehash, err := VerifyPassword(tt.stored, tt.password)
+
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error = %v, want %v", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if match != tt.match || rehash != tt.rehash {
+				t.Errorf("match, rehash = %v, %v, want %v, %v", match, rehash, tt.match, tt.rehash)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"ekhoes-server/config"
+	"ekhoes-server/db"
+	"ekhoes-server/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Refresh tokens are opaque to clients: <base64url(sessionId)>.<random>. Only their SHA-256
+// is stored, under rt:<hash>. Each use deletes the token and issues a new one (rotation).
+// The rotation state of a session lives in the single entry rtf:<sessionId>: the current
+// token and the last maxRotated used ones, to recognize a replay, which revokes the session
+// and so every token descending from the same login. Entries are bounded by the sessions,
+// whatever the number of rotations.
+const (
+	refreshPrefix = "rt"
+	familyPrefix  = "rtf"
+	maxRotated    = 100
+)
+
+type refreshFamily struct {
+	Current string   `json:"current"` // Hash of the live token
+	Used    []string `json:"used"`    // Hashes of the rotated tokens, oldest first
+}
+
+var (
+	InvalidRefreshToken = errors.New("invalid refresh token")
+	RefreshTokenReused  = errors.New("refresh token reused, session revoked")
+)
+
+type refreshEntry struct {
+	SessionId string       `json:"sessionId"`
+	Claims    CustomClaims `json:"claims"` // Of the access tokens issued with it
+	Created   time.Time    `json:"created"`
+}
+
+// Returned by logins and refreshes
+type TokenPair struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refreshToken,omitempty"` // Only for tokens bound to a session
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+var (
+	revokeHooks   []func(sessionId string)
+	revokeHooksMu sync.Mutex
+)
+
+// OnSessionRevoked registers fn to be called when a session is revoked, e.g. to close its websockets
+func OnSessionRevoked(fn func(sessionId string)) {
+	revokeHooksMu.Lock()
+	defer revokeHooksMu.Unlock()
+
+	revokeHooks = append(revokeHooks, fn)
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func refreshTTL() time.Duration {
+	return time.Duration(config.TTL_Refresh()) * time.Minute
+}
+
+func familyKey(sessionId string) string {
+	return fmt.Sprintf("%s:%s", familyPrefix, sessionId)
+}
+
+// Rotation state of a session, empty if it has none
+func getFamily(sessionId string) refreshFamily {
+	var family refreshFamily
+
+	if val, err := db.Get(familyKey(sessionId)); err == nil {
+		if err := json.Unmarshal([]byte(val), &family); err != nil {
+			utils.Err(err)
+		}
+	}
+
+	return family
+}
+
+func setFamily(sessionId string, family refreshFamily) error {
+	data, err := json.Marshal(family)
+	if err != nil {
+		return err
+	}
+
+	return db.SetWithTTL(familyKey(sessionId), data, refreshTTL())
+}
+
+// Session a refresh token was issued for
+func refreshTokenSession(token string) (string, bool) {
+	prefix, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+
+	sessionId, err := base64.RawURLEncoding.DecodeString(prefix)
+	if err != nil || len(sessionId) == 0 {
+		return "", false
+	}
+
+	return string(sessionId), true
+}
+
+/**
+ * IssueTokens returns a short-lived access token for claims (see TTL_Token()), valid for the
+ * module audience, and, when they're bound to a session, a refresh token to get the next one
+ * from POST /auth/refresh. Session-less tokens can't be refreshed: their holder logs in again.
+ */
+func IssueTokens(audience string, claims CustomClaims) (TokenPair, error) {
+	claims.RegisteredClaims = jwt.RegisteredClaims{Audience: jwt.ClaimStrings{audience}}
+
+	return issueTokens(claims)
+}
+
+func issueTokens(claims CustomClaims) (TokenPair, error) {
+	var pair TokenPair
+
+	pair.ExpiresAt = time.Now().Add(time.Duration(config.TTL_Token()) * time.Minute).UTC()
+
+	token, err := GenerateJWT(claims, pair.ExpiresAt)
+	if err != nil {
+		return pair, err
+	}
+
+	pair.Token = token
+
+	if claims.SessionId == "" {
+		return pair, nil
+	}
+
+	pair.RefreshToken, err = newRefreshToken(claims)
+
+	return pair, err
+}
+
+func newRefreshToken(claims CustomClaims) (string, error) {
+	raw := make([]byte, 32)
+
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString([]byte(claims.SessionId)) + "." + base64.RawURLEncoding.EncodeToString(raw)
+	hash := hashRefreshToken(token)
+
+	// Registered claims are set again on every access token, except the audience
+	claims.RegisteredClaims = jwt.RegisteredClaims{Audience: claims.Audience}
+
+	data, err := json.Marshal(refreshEntry{
+		SessionId: claims.SessionId,
+		Claims:    claims,
+		Created:   time.Now().UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := db.SetWithTTL(fmt.Sprintf("%s:%s", refreshPrefix, hash), data, refreshTTL()); err != nil {
+		return "", err
+	}
+
+	family := getFamily(claims.SessionId)
+	family.Current = hash
+
+	if err := setFamily(claims.SessionId, family); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+/**
+ * RefreshTokens exchanges a refresh token for a new pair. A token can be used once:
+ * presenting it again revokes its session.
+ */
+func RefreshTokens(refreshToken string) (TokenPair, error) {
+	var pair TokenPair
+
+	sessionId, ok := refreshTokenSession(refreshToken)
+	if !ok {
+		return pair, InvalidRefreshToken
+	}
+
+	hash := hashRefreshToken(refreshToken)
+	key := fmt.Sprintf("%s:%s", refreshPrefix, hash)
+
+	val, err := db.Get(key)
+
+	if err == db.KeyNotFound {
+		// Already rotated?
+		if slices.Contains(getFamily(sessionId).Used, hash) {
+			utils.Error("Refresh token of session %s reused, revoking the session", sessionId)
+			RevokeSession(sessionId)
+			return pair, RefreshTokenReused
+		}
+		return pair, InvalidRefreshToken
+	} else if err != nil {
+		return pair, err
+	}
+
+	var entry refreshEntry
+
+	if err := json.Unmarshal([]byte(val), &entry); err != nil {
+		return pair, err
+	}
+
+	if entry.SessionId != sessionId {
+		return pair, InvalidRefreshToken
+	}
+
+	// Only one request can rotate a token, a concurrent one is a reuse
+	deleted, err := db.DeleteKey(key)
+
+	if err != nil {
+		return pair, err
+	}
+
+	if !deleted {
+		utils.Error("Refresh token of session %s used concurrently, revoking the session", entry.SessionId)
+		RevokeSession(entry.SessionId)
+		return pair, RefreshTokenReused
+	}
+
+	family := getFamily(entry.SessionId)
+	family.Used = append(family.Used, hash)
+
+	if len(family.Used) > maxRotated {
+		family.Used = family.Used[len(family.Used)-maxRotated:]
+	}
+
+	if err := setFamily(entry.SessionId, family); err != nil {
+		utils.Err(err)
+	}
+
+	if _, err := GetSession(entry.SessionId); err != nil {
+		return pair, InvalidRefreshToken
+	}
+
+	return issueTokens(entry.Claims)
+}
+
+/**
+ * RevokeSession deletes a session and its refresh token, rejects its access tokens,
+ * then runs the OnSessionRevoked() hooks
+ */
+func RevokeSession(sessionId string) {
+	if family := getFamily(sessionId); family.Current != "" {
+		db.DeleteKey(fmt.Sprintf("%s:%s", refreshPrefix, family.Current))
+	}
+
+	db.DeleteKey(familyKey(sessionId))
+
+	if err := RevokeSessionTokens(sessionId); err != nil {
+		utils.Err(err)
+	}
+
+	if _, err := db.DeleteKey(sessionId); err != nil {
+		utils.Err(err)
+	}
+
+	revokeHooksMu.Lock()
+	hooks := revokeHooks
+	revokeHooksMu.Unlock()
+
+	for _, fn := range hooks {
+		fn(sessionId)
+	}
+}
+
+/**
+ * POST /auth/refresh
+ * -d '{ "refreshToken": "..." }'
+ */
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	type Payload struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	var payload Payload
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if payload.RefreshToken == "" {
+		http.Error(w, "missing refresh token", http.StatusBadRequest)
+		return
+	}
+
+	pair, err := RefreshTokens(payload.RefreshToken)
+
+	if errors.Is(err, InvalidRefreshToken) || errors.Is(err, RefreshTokenReused) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error refreshing token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(pair)
+}
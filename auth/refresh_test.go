@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"ekhoes-server/db"
+)
+
+// Internal cache and deny-list, Redis disabled
+func useTestCache(t *testing.T) {
+	t.Helper()
+
+	t.Setenv("EKHOES_REDIS_ENABLED", "false")
+
+	if err := db.OpenCache(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestSession(t *testing.T, appId string) string {
+	t.Helper()
+
+	sessionId, err := CreateSession(appId, Session{User: User{Id: "1000"}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sessionId
+}
+
+func TestRefreshRotation(t *testing.T) {
+	useTestKey(t)
+	useTestCache(t)
+	RegisterAudience("hnw")
+
+	sessionId := newTestSession(t, "hnw")
+
+	pair, err := IssueTokens("hnw", CustomClaims{SessionId: sessionId, UserId: "1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pair.RefreshToken == "" {
+		t.Fatal("no refresh token for a session")
+	}
+
+	// Every use gives a new token, valid once
+	current := pair.RefreshToken
+
+	for i := 0; i < 3; i++ {
+		next, err := RefreshTokens(current)
+		if err != nil {
+			t.Fatalf("refresh %d: %v", i, err)
+		}
+
+		if next.RefreshToken == "" || next.RefreshToken == current {
+			t.Fatalf("refresh %d: refresh token not rotated", i)
+		}
+
+		if id, _, err := VerifySessionToken(next.Token); err != nil || id != sessionId {
+			t.Fatalf("refresh %d: access token of session %q, error %v", i, id, err)
+		}
+
+		current = next.RefreshToken
+	}
+
+	for _, token := range []string{"", "garbage", "bm9wZQ.xyz", pair.RefreshToken + "x"} {
+		if _, err := RefreshTokens(token); !errors.Is(err, InvalidRefreshToken) {
+			t.Errorf("refresh token %q: error %v, want %v", token, err, InvalidRefreshToken)
+		}
+	}
+}
+
+func TestRefreshReuseRevokesSession(t *testing.T) {
+	useTestKey(t)
+	useTestCache(t)
+	RegisterAudience("hnw")
+
+	sessionId := newTestSession(t, "hnw")
+
+	var revoked []string
+	OnSessionRevoked(func(id string) { revoked = append(revoked, id) })
+
+	first, err := IssueTokens("hnw", CustomClaims{SessionId: sessionId, UserId: "1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := RefreshTokens(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A replayed token revokes the whole session...
+	if _, err := RefreshTokens(first.RefreshToken); !errors.Is(err, RefreshTokenReused) {
+		t.Fatalf("reuse: error %v, want %v", err, RefreshTokenReused)
+	}
+
+	if len(revoked) != 1 || revoked[0] != sessionId {
+		t.Errorf("revoke hooks called for %v, want [%s]", revoked, sessionId)
+	}
+
+	if _, err := GetSession(sessionId); !errors.Is(err, SessionNotFound) {
+		t.Errorf("session still there after the reuse, error %v", err)
+	}
+
+	// ...the live refresh token and the access tokens descending from the same login included
+	if _, err := RefreshTokens(second.RefreshToken); !errors.Is(err, InvalidRefreshToken) {
+		t.Errorf("refresh after the reuse: error %v, want %v", err, InvalidRefreshToken)
+	}
+
+	if _, _, err := VerifySessionToken(second.Token); !errors.Is(err, TokenRevoked) {
+		t.Errorf("access token after the reuse: error %v, want %v", err, TokenRevoked)
+	}
+}
+
+func TestSessionlessTokensHaveNoRefresh(t *testing.T) {
+	useTestKey(t)
+	useTestCache(t)
+
+	pair, err := IssueTokens("admin", CustomClaims{UserId: "1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pair.Token == "" || pair.RefreshToken != "" {
+		t.Errorf("token %q, refresh token %q: want only an access token", pair.Token, pair.RefreshToken)
+	}
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"ekhoes-server/config"
+	"ekhoes-server/db"
+)
+
+// Deny-list in Redis, shared by the instances. Without Redis it's kept in a map of this
+// instance rather than in the internal cache, whose LRU eviction would let revoked tokens
+// in again: entries only go away when they expire.
+// rev:jti:<jti> revokes a single token until it expires, rev:ses:<sessionId> every token
+// of a session for the longest lifetime a token can have (TTL_Token()).
+const (
+	revokedTokenPrefix   = "rev:jti"
+	revokedSessionPrefix = "rev:ses"
+)
+
+var (
+	TokenRevoked          = errors.New("token revoked")
+	RevocationUnavailable = errors.New("unable to check revocation") // The deny-list can't be read, not the token's fault
+)
+
+// Key -> expiration, when Redis is disabled
+var (
+	localDenyList   = make(map[string]time.Time)
+	localDenyListMu sync.Mutex
+)
+
+func deny(key string, ttl time.Duration) error {
+	if config.RedisEnabled() {
+		return db.SetWithTTL(key, time.Now().UTC().Format(time.RFC3339), ttl)
+	}
+
+	localDenyListMu.Lock()
+	defer localDenyListMu.Unlock()
+
+	now := time.Now()
+
+	// Revocations are rare, sweeping here keeps the map to the live entries
+	for k, expires := range localDenyList {
+		if now.After(expires) {
+			delete(localDenyList, k)
+		}
+	}
+
+	localDenyList[key] = now.Add(ttl)
+
+	return nil
+}
+
+func denied(key string) (bool, error) {
+	if config.RedisEnabled() {
+		_, err := db.Get(key)
+
+		if err == db.KeyNotFound {
+			return false, nil
+		}
+
+		return err == nil, err
+	}
+
+	localDenyListMu.Lock()
+	defer localDenyListMu.Unlock()
+
+	expires, ok := localDenyList[key]
+
+	return ok && time.Now().Before(expires), nil
+}
+
+// RevokeToken rejects a token until it expires
+func RevokeToken(claims *CustomClaims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+
+	ttl := time.Until(claims.ExpiresAt.Time) + config.JWTLeeway()
+
+	if ttl <= 0 {
+		return nil
+	}
+
+	return deny(fmt.Sprintf("%s:%s", revokedTokenPrefix, claims.ID), ttl)
+}
+
+// RevokeSessionTokens rejects every token issued so far for a session
+func RevokeSessionTokens(sessionId string) error {
+	ttl := time.Duration(config.TTL_Token())*time.Minute + config.JWTLeeway()
+
+	return deny(fmt.Sprintf("%s:%s", revokedSessionPrefix, sessionId), ttl)
+}
+
+// checkRevoked returns TokenRevoked if the token or its session are in the deny-list.
+// When the cache can't be read the token is rejected.
+func checkRevoked(claims *CustomClaims) error {
+	var keys []string
+
+	if claims.SessionId != "" {
+		keys = append(keys, fmt.Sprintf("%s:%s", revokedSessionPrefix, claims.SessionId))
+	}
+
+	if claims.ID != "" {
+		keys = append(keys, fmt.Sprintf("%s:%s", revokedTokenPrefix, claims.ID))
+	}
+
+	for _, key := range keys {
+		revoked, err := denied(key)
+
+		if err != nil {
+			return fmt.Errorf("%w: %w", RevocationUnavailable, err)
+		} else if revoked {
+			return TokenRevoked
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ekhoes-server/db"
+)
+
+// Empty the local deny-list when the test is over
+func resetDenyList(t *testing.T) {
+	t.Cleanup(func() {
+		localDenyListMu.Lock()
+		defer localDenyListMu.Unlock()
+
+		localDenyList = make(map[string]time.Time)
+	})
+}
+
+func checkToken(token string) error {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", token)
+
+	_, err := CheckAuthorization(r, "hnw")
+
+	return err
+}
+
+func TestRevokeToken(t *testing.T) {
+	useTestKey(t)
+	useTestCache(t)
+	resetDenyList(t)
+
+	sessionId := newTestSession(t, "hnw")
+
+	first, _ := IssueTokens("hnw", CustomClaims{SessionId: sessionId, UserId: "1000"})
+	second, _ := IssueTokens("hnw", CustomClaims{SessionId: sessionId, UserId: "1000"})
+
+	claims, err := DecodeJWT(first.Token, "hnw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RevokeToken(claims); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the token with that jti
+	if err := checkToken(first.Token); !errors.Is(err, TokenRevoked) {
+		t.Errorf("revoked token: error %v, want %v", err, TokenRevoked)
+	}
+
+	if err := checkToken(second.Token); err != nil {
+		t.Errorf("other token of the session: %v", err)
+	}
+}
+
+func TestRevokeSessionTokens(t *testing.T) {
+	useTestKey(t)
+	useTestCache(t)
+	resetDenyList(t)
+
+	sessionId := newTestSession(t, "hnw")
+	other := newTestSession(t, "hnw")
+
+	pair, _ := IssueTokens("hnw", CustomClaims{SessionId: sessionId, UserId: "1000"})
+	otherPair, _ := IssueTokens("hnw", CustomClaims{SessionId: other, UserId: "1000"})
+	sessionless, _ := IssueTokens("hnw", CustomClaims{UserId: "1000"})
+
+	// Deleting the session from the admin console revokes its tokens
+	if err := Delete(sessionId); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkToken(pair.Token); !errors.Is(err, TokenRevoked) {
+		t.Errorf("token of the deleted session: error %v, want %v", err, TokenRevoked)
+	}
+
+	if err := checkToken(otherPair.Token); err != nil {
+		t.Errorf("token of another session: %v", err)
+	}
+
+	if err := checkToken(sessionless.Token); err != nil {
+		t.Errorf("session-less token: %v", err)
+	}
+}
+
+func TestLocalDenyList(t *testing.T) {
+	useTestCache(t)
+	resetDenyList(t)
+
+	if err := deny("rev:jti:short", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deny("rev:jti:long", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache size limit must not evict a revocation
+	for i := 0; i < 2000; i++ {
+		db.SetWithTTL(fmt.Sprintf("filler:%d", i), "x", time.Hour)
+	}
+
+	if revoked, _ := denied("rev:jti:long"); !revoked {
+		t.Error("revocation lost when the cache is full")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if revoked, _ := denied("rev:jti:short"); revoked {
+		t.Error("revocation still there after its TTL")
+	}
+
+	// Expired entries are dropped on the next insert
+	deny("rev:jti:next", time.Hour)
+
+	localDenyListMu.Lock()
+	_, found := localDenyList["rev:jti:short"]
+	size := len(localDenyList)
+	localDenyListMu.Unlock()
+
+	if found || size != 2 {
+		t.Errorf("deny-list holds %d entries, expired one found: %v", size, found)
+	}
+}
@@ -63,6 +63,11 @@ func CreateSession(appId string, session Session, ttl time.Duration) (string, er
 }
 
 func Delete(sessionId string) error {
+	// Tokens already issued stop working now, not when they expire
+	if err := RevokeSessionTokens(sessionId); err != nil {
+		return fmt.Errorf("unable to revoke tokens: %w", err)
+	}
+
 	deleted, err := db.DeleteKey(sessionId)
 	if err != nil {
 		return fmt.Errorf("unable to remove key: %w", err)
@@ -77,11 +82,29 @@ func Delete(sessionId string) error {
 }
 
 func DeleteAllSessions() error {
-	err := db.DeleteByPattern("*")
+	keys, err := db.GetKeysByPattern("ses:*")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := RevokeSessionTokens(key); err != nil {
+			return fmt.Errorf("unable to revoke tokens: %w", err)
+		}
+	}
+
+	err = db.DeleteByPattern("ses:*")
 	if err != nil {
 		return fmt.Errorf("unable to remove key: %w", err)
 	}
 
+	// Refresh tokens of the deleted sessions
+	for _, pattern := range []string{refreshPrefix + ":*", familyPrefix + ":*"} {
+		if err := db.DeleteByPattern(pattern); err != nil {
+			return fmt.Errorf("unable to remove key: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -8,16 +8,41 @@ import (
 )
 
 type Module struct {
-	Id          string
-	Name        string
-	InitFunc    func(*chi.Mux) error
-	Install     func() error
-	PostInstall func(...interface{}) error
-	WsHandler   func(auth.User, Message, *Message) error
+	Id           string
+	Name         string
+	InitFunc     func(*chi.Mux) error
+	Install      func() error
+	PostInstall  func(...interface{}) error
+	Router       *Router                                  // Websocket handlers by message type, see NewRouter()
+	WsHandler    func(auth.User, Message, *Message) error // Single handler for every message type, used when Router is nil
+	MessageTypes []string                                 // Message types accepted by WsHandler, announced to clients in the hello handshake
+	Permissions  map[string]Permission                    // Required to send the message types handled by WsHandler
+	RateLimit    *RateLimit                               // Per user limit of websocket messages for this module, nil for none
+	CanSubscribe func(auth.User, string) bool             // Authorizes subscriptions to the module topics ("<id>:..."), nil allows all of them
+}
+
+// Permission returns what's required to send msgType to the module
+func (m Module) Permission(msgType string) Permission {
+	if m.Router != nil {
+		return m.Router.Permission(msgType)
+	}
+
+	return m.Permissions[msgType]
+}
+
+// Token bucket parameters
+type RateLimit struct {
+	Rate  float64 // Messages per second
+	Burst int
 }
 
 type Message struct {
+	Id      string          `json:"id,omitempty"`    // Set by the client, echoed on the reply
+	Seq     uint64          `json:"seq,omitempty"`   // Set by the server on pushes, see ?resume= on /ws
+	Epoch   string          `json:"epoch,omitempty"` // Replay buffer numbering Seq, set with it
 	AppId   string          `json:"appId"`
 	Type    string          `json:"type"`
+	Topic   string          `json:"topic,omitempty"`   // Set on messages delivered through a topic subscription
+	NoReply bool            `json:"noReply,omitempty"` // Fire-and-forget, the server doesn't reply
 	Payload json.RawMessage `json:"payload"`
 }
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Error codes sent to websocket clients in the payload of "error" messages
+const (
+	ErrBadRequest  = "bad_request"
+	ErrNotFound    = "not_found"
+	ErrForbidden   = "forbidden"
+	ErrUnsupported = "unsupported"
+	ErrThrottled   = "throttled"
+	ErrInternal    = "internal"
+)
+
+// Error can be returned by websocket handlers to choose the code sent to the client
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func NewError(code string, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// ErrorMessage builds the "error" reply to in. Errors other than *Error are reported as internal,
+// without their text: the caller logs the real error.
+func ErrorMessage(in Message, err error) Message {
+	var e *Error
+
+	if !errors.As(err, &e) {
+		e = NewError(ErrInternal, "internal error")
+	}
+
+	payload, _ := json.Marshal(e)
+
+	return Message{
+		Id:      in.Id,
+		AppId:   in.AppId,
+		Type:    "error",
+		Payload: payload,
+	}
+}
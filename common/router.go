@@ -0,0 +1,145 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"ekhoes-server/auth"
+)
+
+// Handler of a websocket message type. out already has the AppId of the module.
+type HandlerFunc func(user auth.User, in Message, out *Message) error
+
+// Validator is implemented by payload types needing checks beyond decoding
+type Validator interface {
+	Validate() error
+}
+
+// Permission required to send a message type. Empty fields don't restrict anything.
+type Permission struct {
+	Privilege string // Held by the user, or ek_admin
+	Role      string // Of the user, or ADMIN
+}
+
+// Allowed checks user against the permission
+func (p Permission) Allowed(user auth.User) bool {
+	if p.Privilege != "" && !auth.HasPrivilege(user.Privileges, p.Privilege) {
+		return false
+	}
+
+	if p.Role != "" && !auth.HasRole(user.Roles, p.Role) {
+		return false
+	}
+
+	return true
+}
+
+type route struct {
+	handler    HandlerFunc
+	permission Permission
+}
+
+// RouteOption customizes a route registered on a Router
+type RouteOption func(*route)
+
+// RequirePrivilege restricts a message type to the users holding privilege (or ek_admin)
+func RequirePrivilege(privilege string) RouteOption {
+	return func(r *route) {
+		r.permission.Privilege = privilege
+	}
+}
+
+// RequireRole restricts a message type to the users having role (or ADMIN)
+func RequireRole(role string) RouteOption {
+	return func(r *route) {
+		r.permission.Role = role
+	}
+}
+
+/**
+ * Router dispatches the websocket messages of a module to the handler registered for
+ * their type. Unknown types get an unsupported error, payloads that can't be decoded or
+ * validated a bad_request error.
+ */
+type Router struct {
+	routes map[string]*route
+}
+
+func NewRouter() *Router {
+	return &Router{routes: make(map[string]*route)}
+}
+
+// Handle registers a handler receiving the raw message
+func (r *Router) Handle(msgType string, handler HandlerFunc, options ...RouteOption) {
+	rt := &route{handler: handler}
+
+	for _, option := range options {
+		option(rt)
+	}
+
+	r.routes[msgType] = rt
+}
+
+/**
+ * On registers a handler receiving the payload decoded as T. If T (or *T) implements
+ * Validator, the payload is validated before calling the handler.
+ */
+func On[T any](r *Router, msgType string, handler func(user auth.User, payload T, out *Message) error, options ...RouteOption) {
+	r.Handle(msgType, func(user auth.User, in Message, out *Message) error {
+		var payload T
+
+		if len(in.Payload) > 0 {
+			if err := json.Unmarshal(in.Payload, &payload); err != nil {
+				return NewError(ErrBadRequest, fmt.Sprintf("invalid payload for '%s': %s", msgType, err))
+			}
+		}
+
+		var v any = &payload
+		if _, ok := v.(Validator); !ok {
+			v = payload
+		}
+
+		if validator, ok := v.(Validator); ok {
+			if err := validator.Validate(); err != nil {
+				return NewError(ErrBadRequest, err.Error())
+			}
+		}
+
+		return handler(user, payload, out)
+	}, options...)
+}
+
+// Types returns the registered message types, sorted
+func (r *Router) Types() []string {
+	types := make([]string, 0, len(r.routes))
+
+	for msgType := range r.routes {
+		types = append(types, msgType)
+	}
+
+	sort.Strings(types)
+
+	return types
+}
+
+// Permission returns what's required to send msgType, nothing for unknown types
+func (r *Router) Permission(msgType string) Permission {
+	if rt, ok := r.routes[msgType]; ok {
+		return rt.permission
+	}
+
+	return Permission{}
+}
+
+// Dispatch calls the handler registered for the type of in. Permissions are checked
+// by the caller, see Module.Permission().
+func (r *Router) Dispatch(user auth.User, in Message, out *Message) error {
+	rt, ok := r.routes[in.Type]
+
+	if !ok {
+		return NewError(ErrUnsupported, fmt.Sprintf("unsupported message type '%s'", in.Type))
+	}
+
+	return rt.handler(user, in, out)
+}
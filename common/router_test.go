@@ -0,0 +1,101 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"ekhoes-server/auth"
+)
+
+type testQuery struct {
+	Name string `json:"name"`
+}
+
+func (q testQuery) Validate() error {
+	if q.Name == "" {
+		return errors.New("missing name")
+	}
+
+	return nil
+}
+
+func routerError(err error) string {
+	var e *Error
+
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	return ""
+}
+
+func TestRouterDispatch(t *testing.T) {
+	r := NewRouter()
+
+	var got string
+
+	On(r, "query", func(user auth.User, payload testQuery, out *Message) error {
+		got = payload.Name
+		return nil
+	})
+
+	tests := []struct {
+		name string
+		in   Message
+		code string // Error code, "" for success
+	}{
+		{"decoded payload", Message{Type: "query", Payload: []byte(`{"name":"test"}`)}, ""},
+		{"undecodable payload", Message{Type: "query", Payload: []byte(`{"name":1}`)}, ErrBadRequest},
+		{"invalid payload", Message{Type: "query", Payload: []byte(`{}`)}, ErrBadRequest},
+		{"unknown type", Message{Type: "other"}, ErrUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ""
+
+			err := r.Dispatch(auth.User{}, tt.in, &Message{})
+
+			if code := routerError(err); code != tt.code {
+				t.Fatalf("error %v, want code %q", err, tt.code)
+			}
+
+			if tt.code == "" && got != "test" {
+				t.Errorf("handler got %q", got)
+			}
+		})
+	}
+}
+
+func TestRouterPermissions(t *testing.T) {
+	r := NewRouter()
+	noop := func(auth.User, Message, *Message) error { return nil }
+
+	r.Handle("write", noop, RequirePrivilege("ek_write"))
+	r.Handle("manage", noop, RequireRole("MANAGER"))
+	r.Handle("read", noop)
+
+	if types := r.Types(); len(types) != 3 || types[0] != "manage" || types[2] != "write" {
+		t.Errorf("types %v, want them sorted", types)
+	}
+
+	tests := []struct {
+		msgType string
+		user    auth.User
+		want    bool
+	}{
+		{"read", auth.User{}, true},
+		{"unknown", auth.User{}, true},
+		{"write", auth.User{}, false},
+		{"write", auth.User{Privileges: "ek_read,ek_write"}, true},
+		{"write", auth.User{Privileges: "ek_admin"}, true},
+		{"manage", auth.User{Roles: "USER"}, false},
+		{"manage", auth.User{Roles: "ADMIN"}, true},
+	}
+
+	for _, tt := range tests {
+		if got := r.Permission(tt.msgType).Allowed(tt.user); got != tt.want {
+			t.Errorf("%s by %+v: allowed %v, want %v", tt.msgType, tt.user, got, tt.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -74,10 +75,71 @@ func JWTSecret() string {
 	return os.Getenv("EKHOES_JWT_SECRET")
 }
 
+// iss claim of the tokens, checked when they're decoded
+func JWTIssuer() string {
+	issuer := "ekhoes-server"
+
+	if os.Getenv("EKHOES_JWT_ISSUER") != "" {
+		issuer = os.Getenv("EKHOES_JWT_ISSUER")
+	}
+
+	return issuer
+}
+
+// Clock skew tolerated on exp, nbf and iat
+func JWTLeeway() time.Duration {
+	seconds := 30
+
+	if os.Getenv("EKHOES_JWT_LEEWAY") != "" {
+		seconds, _ = strconv.Atoi(os.Getenv("EKHOES_JWT_LEEWAY"))
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// PEM file of the private key signing the tokens (RSA, ECDSA or Ed25519). If empty, tokens are signed with JWTSecret() (HS256)
+func JWTPrivateKey() string {
+	return os.Getenv("EKHOES_JWT_PRIVATE_KEY")
+}
+
+// Key id of the signing key, by default its JWK thumbprint
+func JWTKeyId() string {
+	return os.Getenv("EKHOES_JWT_KEY_ID")
+}
+
+// PEM files of the keys that are no longer used to sign but still verify tokens (key rotation).
+// Entries are "path" or "kid=path"
+func JWTVerificationKeys() []string {
+	var list []string
+
+	for _, entry := range strings.Split(os.Getenv("EKHOES_JWT_VERIFY_KEYS"), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+
+	return list
+}
+
+// Unique in the cluster: messages of the bus sent by this name are ignored.
+// Defaults to <hostname>-<pid>, so that nodes never mistake each other for themselves.
 func InstanceName() string {
-	return os.Getenv("EKHOES_INSTANCE_NAME")
+	if name := os.Getenv("EKHOES_INSTANCE_NAME"); name != "" {
+		return name
+	}
+
+	return defaultInstanceName
 }
 
+var defaultInstanceName = func() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "ekhoes"
+	}
+
+	return hostname + "-" + strconv.Itoa(os.Getpid())
+}()
+
 func TTL_Session() int {
 	ttl := 1440
 
@@ -100,6 +162,18 @@ func TTL_Token() int {
 	return ttl
 }
 
+// Minutes a refresh token can be used, each refresh issues a new one
+func TTL_Refresh() int {
+	ttl := 43200
+
+	if os.Getenv("EKHOES_TTL_REFRESH") != "" {
+		ttl, _ = strconv.Atoi(os.Getenv("EKHOES_TTL_REFRESH"))
+
+	}
+
+	return ttl
+}
+
 func TTL_EphemeralHotspots() int {
 	ttl := 5
 
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Every origin is allowed, to be used only while developing
+func OriginDevMode() bool {
+	return os.Getenv("EKHOES_ORIGIN_DEV_MODE") == "true"
+}
+
+// Comma separated list of allowed origins. Entries can be:
+//   - an exact origin:      https://app.example.com
+//   - an exact host:        app.example.com, localhost:8081 (any scheme)
+//   - a wildcard subdomain: *.example.com (doesn't match example.com itself)
+func AllowedOrigins() []string {
+	var list []string
+
+	for _, item := range strings.Split(os.Getenv("EKHOES_ALLOWED_ORIGINS"), ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// OriginAllowed tells if a browser request from origin may reach the server.
+// Same-origin requests (origin host equal to the requested host) are always allowed.
+func OriginAllowed(origin string, requestHost string) bool {
+	if OriginDevMode() {
+		return true
+	}
+
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	if u.Host == strings.ToLower(requestHost) {
+		return true
+	}
+
+	for _, allowed := range AllowedOrigins() {
+		switch {
+		case strings.Contains(allowed, "://"):
+			if allowed == u.Scheme+"://"+u.Host {
+				return true
+			}
+		case strings.HasPrefix(allowed, "*."):
+			if strings.HasSuffix(u.Hostname(), allowed[1:]) {
+				return true
+			}
+		case strings.Contains(allowed, ":"):
+			if allowed == u.Host {
+				return true
+			}
+		default:
+			if allowed == u.Hostname() {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,49 @@
+package config
+
+import "testing"
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string
+		devMode bool
+		origin  string
+		host    string
+		want    bool
+	}{
+		{"same origin", "", false, "https://api.example.com", "api.example.com", true},
+		{"same origin other case", "", false, "https://API.example.com", "api.example.com", true},
+		{"nothing allowed", "", false, "https://app.example.com", "api.example.com", false},
+		{"exact origin", "https://app.example.com", false, "https://app.example.com", "api.example.com", true},
+		{"exact origin other scheme", "https://app.example.com", false, "http://app.example.com", "api.example.com", false},
+		{"exact origin other port", "https://app.example.com", false, "https://app.example.com:8443", "api.example.com", false},
+		{"exact host any scheme", "app.example.com", false, "http://app.example.com", "api.example.com", true},
+		{"exact host any port", "app.example.com", false, "http://app.example.com:3000", "api.example.com", true},
+		{"host and port", "localhost:8081", false, "http://localhost:8081", "api.example.com", true},
+		{"host and other port", "localhost:8081", false, "http://localhost:8082", "api.example.com", false},
+		{"wildcard", "*.example.com", false, "https://app.example.com", "api.example.org", true},
+		{"wildcard nested", "*.example.com", false, "https://a.b.example.com", "api.example.org", true},
+		{"wildcard apex", "*.example.com", false, "https://example.com", "api.example.org", false},
+		{"wildcard lookalike", "*.example.com", false, "https://evilexample.com", "api.example.org", false},
+		{"list", "https://a.example.org, b.example.org", false, "https://b.example.org", "api.example.com", true},
+		{"malformed origin", "app.example.com", false, "::not a url", "api.example.com", false},
+		{"null origin", "app.example.com", false, "null", "api.example.com", false},
+		{"dev mode", "", true, "https://anything.test", "api.example.com", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("EKHOES_ALLOWED_ORIGINS", tt.allowed)
+
+			if tt.devMode {
+				t.Setenv("EKHOES_ORIGIN_DEV_MODE", "true")
+			} else {
+				t.Setenv("EKHOES_ORIGIN_DEV_MODE", "")
+			}
+
+			if got := OriginAllowed(tt.origin, tt.host); got != tt.want {
+				t.Errorf("OriginAllowed(%q, %q) = %v, want %v", tt.origin, tt.host, got, tt.want)
+			}
+		})
+	}
+}
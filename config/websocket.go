@@ -0,0 +1,191 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+func intFromEnv(name string, def int) int {
+	value := def
+
+	if os.Getenv(name) != "" {
+		if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+			value = v
+		}
+	}
+
+	return value
+}
+
+// Size of the outbound queue of each websocket connection
+func WS_SendQueueSize() int {
+	return intFromEnv("EKHOES_WS_SEND_QUEUE_SIZE", 256)
+}
+
+// How long the outbound queue may stay full before the client is disconnected
+func WS_SendTimeout() time.Duration {
+	return time.Duration(intFromEnv("EKHOES_WS_SEND_TIMEOUT", 5000)) * time.Millisecond
+}
+
+// Interval between ping frames sent to websocket clients
+func WS_PingInterval() time.Duration {
+	seconds := intFromEnv("EKHOES_WS_PING_INTERVAL", 30)
+
+	// The writer ticks at this interval, time.NewTicker() panics on non-positive ones
+	if seconds < 1 {
+		seconds = 30
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// Time allowed to receive a pong (or any other frame) before the connection is considered dead
+func WS_PongTimeout() time.Duration {
+	return time.Duration(intFromEnv("EKHOES_WS_PONG_TIMEOUT", 60)) * time.Second
+}
+
+// Negotiate permessage-deflate compression with websocket clients
+func WS_Compression() bool {
+	return os.Getenv("EKHOES_WS_COMPRESSION") == "true"
+}
+
+// Compression level, from -2 (Huffman only) to 9 (best compression)
+func WS_CompressionLevel() int {
+	return intFromEnv("EKHOES_WS_COMPRESSION_LEVEL", 1)
+}
+
+// Maximum size in bytes of an inbound websocket message
+func WS_MaxMessageSize() int64 {
+	return int64(intFromEnv("EKHOES_WS_MAX_MESSAGE_SIZE", 65536))
+}
+
+func WS_ReadBufferSize() int {
+	return intFromEnv("EKHOES_WS_READ_BUFFER_SIZE", 4096)
+}
+
+func WS_WriteBufferSize() int {
+	return intFromEnv("EKHOES_WS_WRITE_BUFFER_SIZE", 4096)
+}
+
+func floatFromEnv(name string, def float64) float64 {
+	value := def
+
+	if os.Getenv(name) != "" {
+		if v, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil {
+			value = v
+		}
+	}
+
+	return value
+}
+
+// Inbound messages per second allowed on a single websocket connection (0 = unlimited)
+func WS_RateConnection() float64 {
+	return floatFromEnv("EKHOES_WS_RATE_CONNECTION", 20)
+}
+
+func WS_BurstConnection() int {
+	return intFromEnv("EKHOES_WS_BURST_CONNECTION", 40)
+}
+
+// Inbound messages per second allowed to a user, summing all its connections (0 = unlimited)
+func WS_RateUser() float64 {
+	return floatFromEnv("EKHOES_WS_RATE_USER", 50)
+}
+
+func WS_BurstUser() int {
+	return intFromEnv("EKHOES_WS_BURST_USER", 100)
+}
+
+// Throttled messages per minute after which the connection is closed
+func WS_MaxViolations() int {
+	return intFromEnv("EKHOES_WS_MAX_VIOLATIONS", 20)
+}
+
+// Maximum websocket connections per session (0 = unlimited)
+func WS_MaxConnectionsPerSession() int {
+	return intFromEnv("EKHOES_WS_MAX_PER_SESSION", 5)
+}
+
+// Maximum websocket connections per user (0 = unlimited)
+func WS_MaxConnectionsPerUser() int {
+	return intFromEnv("EKHOES_WS_MAX_PER_USER", 20)
+}
+
+// Maximum websocket connections on this instance (0 = unlimited)
+func WS_MaxConnections() int {
+	return intFromEnv("EKHOES_WS_MAX_TOTAL", 10000)
+}
+
+// When a session reaches its limit, close its oldest connection instead of rejecting the new one
+func WS_EvictOldest() bool {
+	return os.Getenv("EKHOES_WS_EVICT_OLDEST") == "true"
+}
+
+// Seconds a connection stays in the cluster registry without being refreshed by its instance
+func WS_RegistryTTL() time.Duration {
+	seconds := intFromEnv("EKHOES_WS_REGISTRY_TTL", 30)
+
+	// The heartbeat runs every TTL / 3, at least once a second
+	if seconds < 3 {
+		seconds = 30
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// Server pushes kept per session to be replayed on reconnect (0 = no replay)
+func WS_ReplaySize() int {
+	return intFromEnv("EKHOES_WS_REPLAY_SIZE", 100)
+}
+
+// Seconds a pushed message can be replayed. The buffer of a session without connections is dropped after the same time.
+func WS_ReplayMaxAge() time.Duration {
+	return time.Duration(intFromEnv("EKHOES_WS_REPLAY_MAX_AGE", 120)) * time.Second
+}
+
+// Seconds a session stays online after its last connection is gone, to ride out reconnects
+func WS_ResumeGrace() time.Duration {
+	return time.Duration(intFromEnv("EKHOES_WS_RESUME_GRACE", 30)) * time.Second
+}
+
+// Seconds to wait before publishing a presence change, so that flapping connections publish only their final state
+func WS_PresenceDebounce() time.Duration {
+	return time.Duration(intFromEnv("EKHOES_WS_PRESENCE_DEBOUNCE", 5)) * time.Second
+}
+
+// Seconds given to clients to leave on shutdown before their connections are closed
+func WS_DrainGrace() time.Duration {
+	return time.Duration(intFromEnv("EKHOES_WS_DRAIN_GRACE", 10)) * time.Second
+}
+
+// Reconnect delay suggested to clients on shutdown, in milliseconds
+func WS_ReconnectDelay() time.Duration {
+	return time.Duration(intFromEnv("EKHOES_WS_RECONNECT_DELAY", 1000)) * time.Millisecond
+}
+
+// Random delay added to WS_ReconnectDelay() for each client, in milliseconds, so that they don't come back all together
+func WS_ReconnectJitter() time.Duration {
+	return time.Duration(intFromEnv("EKHOES_WS_RECONNECT_JITTER", 5000)) * time.Millisecond
+}
+
+// Require clients to open with a hello message, otherwise it's optional
+func WS_RequireHello() bool {
+	return os.Getenv("EKHOES_WS_REQUIRE_HELLO") == "true"
+}
+
+// Seconds allowed to send the auth message, when the token isn't in the upgrade request
+func WS_AuthTimeout() time.Duration {
+	return time.Duration(intFromEnv("EKHOES_WS_AUTH_TIMEOUT", 10)) * time.Second
+}
+
+// Topics accepted in a single subscribe or unsubscribe message
+func WS_MaxTopicsPerMessage() int {
+	return intFromEnv("EKHOES_WS_MAX_TOPICS_PER_MESSAGE", 20)
+}
+
+// Topics a connection can be subscribed to at the same time
+func WS_MaxSubscriptions() int {
+	return intFromEnv("EKHOES_WS_MAX_SUBSCRIPTIONS", 200)
+}
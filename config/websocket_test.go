@@ -0,0 +1,46 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWS_PingInterval(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 30 * time.Second},
+		{"10", 10 * time.Second},
+		{"0", 30 * time.Second},
+		{"-5", 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("EKHOES_WS_PING_INTERVAL", tt.value)
+
+		if got := WS_PingInterval(); got != tt.want {
+			t.Errorf("EKHOES_WS_PING_INTERVAL=%q: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestWS_RegistryTTL(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 30 * time.Second},
+		{"3", 3 * time.Second},
+		{"2", 30 * time.Second},
+		{"0", 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("EKHOES_WS_REGISTRY_TTL", tt.value)
+
+		if got := WS_RegistryTTL(); got != tt.want {
+			t.Errorf("EKHOES_WS_REGISTRY_TTL=%q: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -150,7 +150,23 @@ func GetKeysByPattern(pattern string) ([]string, error) {
 	var keys []string
 
 	if config.RedisEnabled() {
-		keys, err = RedisGetConnection().Keys(ctx, pattern).Result()
+		// SCAN instead of KEYS, that blocks the server while walking the whole keyspace
+		var cursor uint64
+
+		for {
+			var page []string
+
+			page, cursor, err = RedisGetConnection().Scan(ctx, cursor, pattern, 100).Result()
+			if err != nil {
+				return nil, fmt.Errorf("scan error: %w", err)
+			}
+
+			keys = append(keys, page...)
+
+			if cursor == 0 {
+				break
+			}
+		}
 	} else {
 		keys = cache.GetKeysByPattern(pattern, 0)
 	}
@@ -227,3 +243,31 @@ func DeleteByPattern(pattern string) error {
 
 	return nil
 }
+
+// Hashes are only available with Redis: they are shared state of the cluster,
+// a single instance keeps that in memory.
+var RedisNotEnabled = errors.New("redis not enabled")
+
+func HashSet(key string, field string, value interface{}) error {
+	if !config.RedisEnabled() {
+		return RedisNotEnabled
+	}
+
+	return RedisGetConnection().HSet(ctx, key, field, value).Err()
+}
+
+func HashGetAll(key string) (map[string]string, error) {
+	if !config.RedisEnabled() {
+		return nil, RedisNotEnabled
+	}
+
+	return RedisGetConnection().HGetAll(ctx, key).Result()
+}
+
+func HashDelete(key string, fields ...string) error {
+	if !config.RedisEnabled() {
+		return RedisNotEnabled
+	}
+
+	return RedisGetConnection().HDel(ctx, key, fields...).Err()
+}
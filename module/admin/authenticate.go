@@ -6,6 +6,7 @@ import (
 
 	"ekhoes-server/auth"
 	"ekhoes-server/db"
+	"ekhoes-server/utils"
 )
 
 type AuthResult struct {
@@ -33,7 +34,7 @@ func Authenticate(email string, password string) (*AuthResult, error) {
 
 		//query = strings.ReplaceAll(query, "{{DB_SCHEMA}}", os.Getenv("DB_SCHEMA"))
 
-		rows, err := conn.Query(query, password, email)
+		rows, err := conn.Query(query, email)
 
 		if errors.Is(err, sql.ErrNoRows) {
 			result.Message = "User not found"
@@ -41,18 +42,12 @@ func Authenticate(email string, password string) (*AuthResult, error) {
 		} else if err != nil {
 			return nil, err
 		}
+		defer rows.Close()
 
-		password_match := false
+		var stored sql.NullString
 
 		for rows.Next() {
-			_ = rows.Scan(&result.User.Id, &result.User.Name, &password_match, &result.User.Roles, &result.User.Privileges)
-
-			if !password_match {
-				result.Message = "Wrong password"
-				return result, nil
-			}
-
-			result.Success = true
+			_ = rows.Scan(&result.User.Id, &result.User.Name, &stored, &result.User.Roles, &result.User.Privileges)
 		}
 
 		if result.User.Id == "" {
@@ -60,6 +55,30 @@ func Authenticate(email string, password string) (*AuthResult, error) {
 			return result, nil
 		}
 
+		// Passwords are verified here, not in SQL, so that every hash format works on both databases
+
+		match, rehash, err := auth.VerifyPassword(stored.String, password)
+
+		// A corrupted hash is a wrong password for the client, the details stay in the log
+		if errors.Is(err, auth.InvalidHash) {
+			utils.Error("Invalid password hash for user %s: %s", result.User.Id, err.Error())
+			result.Message = "Wrong password"
+			return result, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !match {
+			result.Message = "Wrong password"
+			return result, nil
+		}
+
+		result.Success = true
+
+		if rehash {
+			auth.RehashPassword(SqlFS, result.User.Id, password)
+		}
+
 	} else {
 		return nil, errors.New("Database unavailable")
 	}
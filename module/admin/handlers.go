@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"ekhoes-server/auth"
+	"ekhoes-server/websocket"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -15,14 +16,14 @@ import (
  */
 func GetSessionsHandler(w http.ResponseWriter, r *http.Request) {
 
-	claims, err := auth.CheckAuthorization(r)
+	claims, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	if auth.HasPrivilege(claims["privileges"].(string), "ek_read_session") == false {
+	if auth.HasPrivilege(claims.Privileges, "ek_read_session") == false {
 		http.Error(w, "missing required privileges", http.StatusUnauthorized)
 		return
 	}
@@ -44,14 +45,14 @@ func GetSessionsHandler(w http.ResponseWriter, r *http.Request) {
  */
 func DeleteSessionHandler(w http.ResponseWriter, r *http.Request) {
 
-	claims, err := auth.CheckAuthorization(r)
+	claims, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	if auth.HasPrivilege(claims["privileges"].(string), "ek_delete_session") == false {
+	if auth.HasPrivilege(claims.Privileges, "ek_delete_session") == false {
 		http.Error(w, "missing required privileges", http.StatusUnauthorized)
 		return
 	}
@@ -64,6 +65,9 @@ func DeleteSessionHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Session deleted: %s\n", sessionId)
 	}
 
+	// The token is no longer valid, close the sockets opened with it
+	websocket.DisconnectSession(sessionId, "Session deleted")
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 }
@@ -73,14 +77,14 @@ func DeleteSessionHandler(w http.ResponseWriter, r *http.Request) {
  */
 func DeleteAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
 
-	claims, err := auth.CheckAuthorization(r)
+	claims, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	if auth.HasPrivilege(claims["privileges"].(string), "ek_delete_session") == false {
+	if auth.HasPrivilege(claims.Privileges, "ek_delete_session") == false {
 		http.Error(w, "missing required privileges", http.StatusUnauthorized)
 		return
 	}
@@ -95,6 +99,8 @@ func DeleteAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("All sessions deleted")
 
+	websocket.DisconnectEveryone("Session deleted")
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 }
@@ -51,6 +51,9 @@ func Init(r *chi.Mux) error {
 			r.Delete("/sessions", DeleteAllSessionsHandler)
 
 			r.Get("/ws", websocket.GetConnectionsHandler)
+			r.Post("/ws/message", websocket.SendMessageHandler)
+			r.Delete("/ws/{connectionId}", websocket.DisconnectConnectionHandler)
+			r.Delete("/ws", websocket.DisconnectUserHandler)
 
 			r.Get("/system", GetSystemInfo)
 			r.Get("/top", TopCpuProcesses)
@@ -1,6 +1,7 @@
 package admin
 
 import (
+	"ekhoes-server/auth"
 	"ekhoes-server/db"
 	"ekhoes-server/utils"
 	"errors"
@@ -44,7 +45,12 @@ func CreateAdmin(args ...interface{}) error {
 
 	utils.Log("Creating admin user %s...", email)
 
-	if err := db.ExecuteSQL(SqlFS, "create_user.sql", "1000", "Administrator", email, "admin", "enabled"); err != nil {
+	hash, err := auth.HashPassword("admin")
+	if err != nil {
+		return err
+	}
+
+	if err := db.ExecuteSQL(SqlFS, "create_user.sql", "1000", "Administrator", email, hash, "enabled"); err != nil {
 		return err
 	}
 
@@ -12,8 +12,10 @@ import (
 )
 
 /**
- * POST /login
+ * POST /login[?nosession]
  * -H "x-user-agent: Radar/1.0.0" -H "x-platform: Android" -d '{ email: "admin@hal9k.net", password: "admin" }'
+ * With nosession (cli) no session is created: the token is short-lived (TTL_Token()) and has no
+ * refresh token, the cli logs in again when it gets 401 "token expired".
  */
 func Login(w http.ResponseWriter, r *http.Request) {
 
@@ -73,7 +75,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		Privileges: authRes.User.Privileges,
 	}
 
-	token, err := auth.GenerateJWT(claims, time.Time{})
+	tokens, err := auth.IssueTokens(thisModule.Id, claims)
 
 	if err != nil {
 		log.Println(err)
@@ -85,7 +87,8 @@ func Login(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf(`{"token":"%s", "name":"%s", "id":"%s", "hostname":"%s" }`, token, authRes.User.Name, authRes.User.Id, hostname)))
+	w.Write([]byte(fmt.Sprintf(`{"token":"%s", "refreshToken":"%s", "expiresAt":"%s", "name":"%s", "id":"%s", "hostname":"%s" }`,
+		tokens.Token, tokens.RefreshToken, tokens.ExpiresAt.Format(time.RFC3339), authRes.User.Name, authRes.User.Id, hostname)))
 
 	//fmt.Println(token)
 
@@ -1 +1 @@
-insert into ekhoes.USER_ROLES("user_id", "roles") values (?, ?);
+insert into USER_ROLES("user_id", "roles") values (?, ?);
@@ -2,7 +2,7 @@
 SELECT
     u.id,
     u.name,
-    (u.password = ?) AS password_match,
+    u.password,
     GROUP_CONCAT(DISTINCT ur.roles) AS roles,
     GROUP_CONCAT(DISTINCT rp.id_privilege) AS privileges
 FROM 
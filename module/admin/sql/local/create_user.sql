@@ -1,3 +1,3 @@
 
-insert into ekhoes.users ("id", "name", "email", "password", "status") values (?, ?, ?, crypt(?, gen_salt('bf')), ?);
+insert into users ("id", "name", "email", "password", "status") values (?, ?, ?, ?, ?);
 
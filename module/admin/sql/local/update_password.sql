@@ -0,0 +1 @@
+UPDATE users SET password = ?, updated = CURRENT_TIMESTAMP WHERE id = ?;
@@ -1,7 +1,7 @@
 SELECT 
 	u.id,
 	u.name,
-	(u.password = crypt($1, u.password)) AS password_match,
+	u.password,
 	STRING_AGG(DISTINCT ur.roles, ', ') AS roles,
 	STRING_AGG(DISTINCT rp.id_privilege, ', ') AS privileges
 FROM 
@@ -11,7 +11,7 @@ JOIN
 LEFT JOIN 
 	admin.roles_privileges rp ON ur.roles = rp.id_role
 WHERE 
-	LOWER(u.email) = LOWER($2)
+	LOWER(u.email) = LOWER($1)
 	AND u.status = 'enabled'
 GROUP BY 
 	u.id
@@ -0,0 +1 @@
+UPDATE admin.users SET password = $1, updated = NOW() WHERE id = $2;
@@ -26,7 +26,7 @@ type SystemInfo struct {
 }
 
 func GetSystemInfo(w http.ResponseWriter, r *http.Request) {
-	_, err := auth.CheckAuthorization(r)
+	_, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
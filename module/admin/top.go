@@ -18,7 +18,7 @@ type ProcInfo struct {
 }
 
 func TopCpuProcesses(w http.ResponseWriter, r *http.Request) {
-	_, err := auth.CheckAuthorization(r)
+	_, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
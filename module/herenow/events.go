@@ -0,0 +1,173 @@
+package herenow
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"ekhoes-server/auth"
+	"ekhoes-server/common"
+	"ekhoes-server/utils"
+	"ekhoes-server/websocket"
+)
+
+// Hotspots are published to every geohash cell containing them, from
+// precision 1 (~5000km) to maxGeohashPrecision (~1.2km), so clients can
+// subscribe to the cells covering their viewport at any zoom level.
+const maxGeohashPrecision = 6
+
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+func geohash(latitude float64, longitude float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+
+	hash := make([]byte, 0, precision)
+	bit, ch := 0, 0
+	even := true
+
+	for len(hash) < precision {
+		if even {
+			mid := (lonRange[0] + lonRange[1]) / 2
+			if longitude >= mid {
+				ch |= 1 << (4 - bit)
+				lonRange[0] = mid
+			} else {
+				lonRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if latitude >= mid {
+				ch |= 1 << (4 - bit)
+				latRange[0] = mid
+			} else {
+				latRange[1] = mid
+			}
+		}
+
+		even = !even
+
+		if bit < 4 {
+			bit++
+		} else {
+			hash = append(hash, geohashBase32[ch])
+			bit, ch = 0, 0
+		}
+	}
+
+	return string(hash)
+}
+
+func HotspotTopic(hotspotId string) string {
+	return fmt.Sprintf("%s:hotspot:%s", thisModule.Id, hotspotId)
+}
+
+func BoundariesTopic(geohash string) string {
+	return fmt.Sprintf("%s:bbox:%s", thisModule.Id, geohash)
+}
+
+/**
+ * Only the owner can follow a private hotspot
+ */
+func canSubscribe(user auth.User, topic string) bool {
+	hotspotId, ok := strings.CutPrefix(topic, HotspotTopic(""))
+	if !ok {
+		return true
+	}
+
+	owner, private, err := getHotspotVisibility(hotspotId)
+	if err != nil {
+		utils.Err(err)
+		return false
+	}
+
+	return !private || owner == user.Id
+}
+
+/**
+ * Notify subscribers of a hotspot and of the areas containing it.
+ * eventType is one of hotspotCreated, hotspotUpdated, hotspotDeleted.
+ * Private hotspots are never published on topics: only the owner's connections get them.
+ */
+func publishHotspotEvent(eventType string, hotspot *Hotspot) {
+	payload, err := json.Marshal(hotspot)
+	if err != nil {
+		utils.Err(err)
+		return
+	}
+
+	msg := common.Message{
+		AppId:   thisModule.Id,
+		Type:    eventType,
+		Payload: payload,
+	}
+
+	if hotspot.Private {
+		websocket.SendToUser(hotspot.Owner, msg)
+		return
+	}
+
+	websocket.Publish(HotspotTopic(hotspot.Id), msg)
+
+	hash := geohash(hotspot.Position.Latitude, hotspot.Position.Longitude, maxGeohashPrecision)
+
+	for i := 1; i <= len(hash); i++ {
+		websocket.Publish(BoundariesTopic(hash[:i]), msg)
+	}
+}
+
+/**
+ * Push a new comment to the users subscribed to its hotspot, except its author
+ */
+func notifyComment(comment *Comment, authorId string) {
+	subscribers, err := getSubscribers(comment.HotspotId)
+	if err != nil {
+		utils.Err(err)
+		return
+	}
+
+	payload, err := json.Marshal(comment)
+	if err != nil {
+		utils.Err(err)
+		return
+	}
+
+	msg := common.Message{
+		AppId:   thisModule.Id,
+		Type:    "commentAdded",
+		Payload: payload,
+	}
+
+	for _, userId := range subscribers {
+		if userId != authorId {
+			websocket.SendToUser(userId, msg)
+		}
+	}
+}
+
+/**
+ * Tell the subscribers of a user's public hotspots when the owner comes online or goes offline
+ */
+func publishOwnerPresence(presence websocket.Presence) {
+	hotspots, err := getOwnedPublicHotspots(presence.UserId)
+	if err != nil {
+		utils.Err(err)
+		return
+	}
+
+	payload, err := json.Marshal(presence)
+	if err != nil {
+		utils.Err(err)
+		return
+	}
+
+	msg := common.Message{
+		AppId:   thisModule.Id,
+		Type:    "ownerPresence",
+		Payload: payload,
+	}
+
+	for _, id := range hotspots {
+		websocket.Publish(HotspotTopic(id), msg)
+	}
+}
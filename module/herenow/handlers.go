@@ -2,6 +2,7 @@ package herenow
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -20,7 +21,7 @@ import (
 func addCorsHeaders(w http.ResponseWriter, r *http.Request) {
 	origin := r.Header.Get("Origin")
 
-	if origin != "" {
+	if origin != "" && config.OriginAllowed(origin, r.Host) {
 		// Imposta l'origine della richiesta come origine consentita
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 		w.Header().Set("Vary", "Origin") // Importante per caching corretto
@@ -31,7 +32,7 @@ func addCorsHeaders(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 }
 
-func createGuestSession(credentials auth.Credentials, remoteAddr string) (auth.Session, string, error) {
+func createGuestSession(credentials auth.Credentials, remoteAddr string) (auth.Session, auth.TokenPair, error) {
 	utils.Debug("Creating guest session")
 
 	user := auth.User{
@@ -54,10 +55,10 @@ func createGuestSession(credentials auth.Credentials, remoteAddr string) (auth.S
 	sessionId, err := auth.CreateSession(thisModule.Id, session, time.Duration(config.TTL_Session())*time.Minute)
 
 	if err != nil {
-		return session, "", err
+		return session, auth.TokenPair{}, err
 	}
 
-	// Create token
+	// Create tokens
 
 	claims := auth.CustomClaims{
 		SessionId: sessionId,
@@ -68,13 +69,9 @@ func createGuestSession(credentials auth.Credentials, remoteAddr string) (auth.S
 		IsGuest:   true,
 	}
 
-	token, err := auth.GenerateJWT(claims, time.Now().Add(time.Duration(config.TTL_Token())*time.Minute))
+	tokens, err := auth.IssueTokens(thisModule.Id, claims)
 
-	if err != nil {
-		return session, "", err
-	}
-
-	return session, token, nil
+	return session, tokens, err
 }
 
 func WelcomeHandler(w http.ResponseWriter, r *http.Request) {
@@ -92,7 +89,10 @@ func WelcomeHandler(w http.ResponseWriter, r *http.Request) {
 
 	sessionId := ""
 	token := ""
-	var sess auth.Session
+	var (
+		sess   auth.Session
+		tokens auth.TokenPair // Only when a new session is created
+	)
 
 	// Get client info
 
@@ -116,7 +116,7 @@ func WelcomeHandler(w http.ResponseWriter, r *http.Request) {
 		// Create guest session
 		utils.Debug("Client doesn't have a token")
 
-		sess, token, err = createGuestSession(credentials, r.RemoteAddr)
+		sess, tokens, err = createGuestSession(credentials, r.RemoteAddr)
 
 		if err != nil {
 			log.Println(err)
@@ -128,9 +128,13 @@ func WelcomeHandler(w http.ResponseWriter, r *http.Request) {
 
 		utils.Debug("Decoding token")
 
-		claims, valid, err := auth.DecodeJWT(token)
+		claims, err := auth.DecodeJWT(token, thisModule.Id)
 
-		if err != nil {
+		if errors.Is(err, auth.TokenExpired) {
+			// Expired tokens are renewed with POST /auth/refresh
+			http.Error(w, "token expired", http.StatusUnauthorized)
+			return
+		} else if err != nil {
 			utils.Err(err)
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
@@ -138,7 +142,7 @@ func WelcomeHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Get session id
 
-		sessionId, _ = claims["sessionId"].(string)
+		sessionId = claims.SessionId
 
 		// Retrieve session
 
@@ -146,7 +150,13 @@ func WelcomeHandler(w http.ResponseWriter, r *http.Request) {
 
 		if err == auth.SessionNotFound {
 			utils.Debug("Session not found")
-			sess, token, err = createGuestSession(credentials, r.RemoteAddr)
+			sess, tokens, err = createGuestSession(credentials, r.RemoteAddr)
+
+			if err != nil {
+				log.Println(err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
 		} else if err != nil {
 			utils.Err(err)
 			http.Error(w, err.Error(), http.StatusUnauthorized)
@@ -155,39 +165,37 @@ func WelcomeHandler(w http.ResponseWriter, r *http.Request) {
 			utils.Debug("Session found. Extending TTL...")
 
 			db.UpdateTTL(sessionId, time.Duration(config.TTL_Session())*time.Minute)
+		}
+	}
 
-			if !valid {
-				// Regenerate token
-
-				utils.Debug("Regenerating token...")
+	if tokens.Token != "" {
+		token = tokens.Token
+	}
 
-				newClaims := auth.CustomClaims{
-					SessionId: sessionId,
-					UserId:    sess.User.Id,
-					Email:     credentials.Email,
-					Name:      sess.User.Name,
-					IsUser:    sess.User.IsUSer,
-					IsGuest:   sess.User.IsGuest,
-				}
+	type Response struct {
+		Token        string     `json:"token"`
+		RefreshToken string     `json:"refreshToken,omitempty"`
+		ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+		Name         string     `json:"name"`
+		Id           string     `json:"id"`
+		IsGuest      bool       `json:"isGuest"`
+		IsUser       bool       `json:"isUser"`
+	}
 
-				token, err = auth.GenerateJWT(newClaims, time.Now().Add(time.Minute))
+	response := Response{
+		Token:        token,
+		RefreshToken: tokens.RefreshToken,
+		Name:         sess.User.Name,
+		Id:           sess.User.Id,
+		IsGuest:      sess.User.IsGuest,
+		IsUser:       sess.User.IsUSer,
+	}
 
-				if err != nil {
-					utils.Err(err)
-					http.Error(w, "Error regenerating token", http.StatusInternalServerError)
-					return
-				}
-			}
-		}
+	if !tokens.ExpiresAt.IsZero() {
+		response.ExpiresAt = &tokens.ExpiresAt
 	}
 
-	data := fmt.Sprintf(
-		`{"token":"%s", "name":"%s", "id":"%s", "isGuest":%t, "isUser":%t }`,
-		token,
-		sess.User.Name,
-		sess.User.Id,
-		sess.User.IsGuest,
-		sess.User.IsUSer)
+	data, _ := json.Marshal(response)
 
 	utils.Debug("%s", data)
 
@@ -213,14 +221,14 @@ func GetHotspot(w http.ResponseWriter, r *http.Request) {
 
 	//if len(parts) < 3 {
 	if hotspotId == "" { // All user's hotspots
-		claims, err := auth.CheckAuthorization(r)
+		claims, err := auth.CheckAuthorization(r, thisModule.Id)
 
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		userId = claims["userId"].(string)
+		userId = claims.UserId
 
 		whereCond = "OWNER = $2"
 		whereVal = userId
@@ -331,7 +339,7 @@ func PostHotspot(w http.ResponseWriter, r *http.Request) {
 
 	addCorsHeaders(w, r)
 
-	claims, errAuth := auth.CheckAuthorization(r)
+	claims, errAuth := auth.CheckAuthorization(r, thisModule.Id)
 
 	if errAuth != nil {
 		http.Error(w, errAuth.Error(), http.StatusUnauthorized)
@@ -354,11 +362,11 @@ func PostHotspot(w http.ResponseWriter, r *http.Request) {
 
 	//fmt.Println(claims)
 
-	hotspot.Owner = claims["userId"].(string)
+	hotspot.Owner = claims.UserId
 
 	log.Printf("Creating hotspot %v\n", hotspot)
 
-	if claims["isUser"].(bool) {
+	if claims.IsUser {
 		newHotspot, err = createHotspot(hotspot)
 	} else {
 		newHotspot, err = createEphemeralHotspot(hotspot)
@@ -370,6 +378,8 @@ func PostHotspot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	publishHotspotEvent("hotspotCreated", newHotspot)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(newHotspot)
@@ -382,7 +392,7 @@ func PutHotspot(w http.ResponseWriter, r *http.Request) {
 
 	addCorsHeaders(w, r)
 
-	_, err := auth.CheckAuthorization(r)
+	_, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
@@ -411,13 +421,20 @@ func PutHotspot(w http.ResponseWriter, r *http.Request) {
 
 	query := `update hn.HOTSPOTS set name=$1, description=$2, category=$3, position = ST_SetSRID(ST_MakePoint($4, $5), 4326), start_time = $6, end_time = $7, enabled = $8, private = $9 WHERE id = $10`
 
-	_, err = db.Exec(query, hotspot.Name, hotspot.Description, hotspot.Category, hotspot.Position.Longitude, hotspot.Position.Latitude, hotspot.StartTime, hotspot.EndTime, hotspot.Enabled, hotspot.Private, hotspotId)
+	res, err := db.Exec(query, hotspot.Name, hotspot.Description, hotspot.Category, hotspot.Position.Longitude, hotspot.Position.Latitude, hotspot.StartTime, hotspot.EndTime, hotspot.Enabled, hotspot.Private, hotspotId)
 	if err != nil {
 		log.Println(err.Error())
 		http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Publish what has been stored, not what the client sent
+	if n, _ := res.RowsAffected(); n > 0 {
+		if updated := GetHotspotById(hotspotId); updated != nil {
+			publishHotspotEvent("hotspotUpdated", updated)
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -428,24 +445,26 @@ func DeleteHotspot(w http.ResponseWriter, r *http.Request) {
 
 	addCorsHeaders(w, r)
 
-	claims, err := auth.CheckAuthorization(r)
+	claims, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	userId := claims["userId"].(string)
+	userId := claims.UserId
 
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 || parts[2] == "" {
+	hotspotId := chi.URLParam(r, "id")
+	if hotspotId == "" {
 		http.Error(w, "Missing hotspot Id in URL", http.StatusBadRequest)
 		return
 	}
-	hotspotId := parts[2]
 
 	log.Printf("Deleting hotspot %s...\n", hotspotId)
 
+	// Read it before deletion to know which areas must be notified
+	hotspot := GetHotspotById(hotspotId)
+
 	db := db.DB_GetConnection()
 	if db == nil {
 		log.Println("Database not available")
@@ -455,13 +474,17 @@ func DeleteHotspot(w http.ResponseWriter, r *http.Request) {
 
 	query := `DELETE FROM hn.HOTSPOTS WHERE id = $1 AND owner = $2`
 
-	_, err = db.Exec(query, hotspotId, userId)
+	res, err := db.Exec(query, hotspotId, userId)
 	if err != nil {
 		log.Println(err.Error())
 		http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if n, _ := res.RowsAffected(); n > 0 && hotspot != nil {
+		publishHotspotEvent("hotspotDeleted", hotspot)
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -472,7 +495,7 @@ func LikeHotspot(w http.ResponseWriter, r *http.Request) {
 
 	addCorsHeaders(w, r)
 
-	claims, err := auth.CheckAuthorization(r)
+	claims, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		fmt.Println(err)
@@ -481,7 +504,7 @@ func LikeHotspot(w http.ResponseWriter, r *http.Request) {
 	}
 
 	hotspotId := chi.URLParam(r, "id")
-	userId := claims["userId"].(string)
+	userId := claims.UserId
 	IlikeIt := false
 
 	if r.Method == http.MethodPost {
@@ -506,7 +529,7 @@ func CloneHotspotHandler(w http.ResponseWriter, r *http.Request) {
 
 	addCorsHeaders(w, r)
 
-	_, err := auth.CheckAuthorization(r)
+	_, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		fmt.Println(err)
@@ -515,7 +538,7 @@ func CloneHotspotHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	hotspotId := chi.URLParam(r, "id")
-	//userId := claims["userId"].(string)
+	//userId := claims.UserId
 
 	err = CloneHotspot(hotspotId)
 
@@ -581,7 +604,7 @@ func SubscribeUnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
 
 	//addCorsHeaders(w, r)
 
-	claims, err := auth.CheckAuthorization(r)
+	claims, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		log.Println(err)
@@ -590,7 +613,7 @@ func SubscribeUnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	hotspotId := chi.URLParam(r, "id")
-	userId := claims["userId"].(string)
+	userId := claims.UserId
 	subscriptionFlag := false
 
 	if r.Method == http.MethodPost {
@@ -615,7 +638,7 @@ func GetMySubscriptions(w http.ResponseWriter, r *http.Request) {
 
 	//addCorsHeaders(w, r)
 
-	claims, err := auth.CheckAuthorization(r)
+	claims, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		fmt.Println(err)
@@ -631,7 +654,7 @@ func GetMySubscriptions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userId := claims["userId"].(string)
+	userId := claims.UserId
 	//countFlag := r.URL.Query().Has("count")
 	var count int16
 
@@ -666,7 +689,7 @@ func GetMySubscriptions(w http.ResponseWriter, r *http.Request) {
  */
 func SearchHandler(w http.ResponseWriter, r *http.Request) {
 
-	_, err := auth.CheckAuthorization(r)
+	_, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		fmt.Println(err)
@@ -704,7 +727,7 @@ func SearchHandler(w http.ResponseWriter, r *http.Request) {
  */
 func PostHotspotCommentHandler(w http.ResponseWriter, r *http.Request) {
 
-	_, err := auth.CheckAuthorization(r)
+	claims, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
@@ -731,6 +754,8 @@ func PostHotspotCommentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	notifyComment(insertedComment, claims.UserId)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(insertedComment)
 	w.WriteHeader(http.StatusCreated)
@@ -741,7 +766,7 @@ func PostHotspotCommentHandler(w http.ResponseWriter, r *http.Request) {
  */
 func DeleteHotspotCommentHandler(w http.ResponseWriter, r *http.Request) {
 
-	_, err := auth.CheckAuthorization(r)
+	_, err := auth.CheckAuthorization(r, thisModule.Id)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
@@ -253,6 +253,7 @@ func createHotspot(hotspot Hotspot) (*Hotspot, error) {
 		hotspot.StartTime, hotspot.EndTime, hotspot.Private,
 	).Scan(&created, &updated)
 
+	hotspot.Id = id
 	hotspot.Created = time.Now().UTC()
 	hotspot.Updated = time.Now().UTC()
 
@@ -555,3 +556,100 @@ func getComments(hotspotId string, limit int, offset int32) ([]Comment, error) {
 
 	return comments, nil
 }
+
+/**
+ * Return the ids of the users subscribed to a hotspot
+ */
+func getSubscribers(hotspotId string) ([]string, error) {
+
+	var subscribers []string
+
+	db := db.DB_GetConnection()
+
+	if db == nil {
+		log.Println("Error: database not available")
+		return nil, errors.New("database not available")
+	}
+
+	rows, err := db.Query(`SELECT user_id FROM hn.SUBSCRIPTIONS WHERE hotspot_id = $1`, hotspotId)
+
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userId string
+
+		if err := rows.Scan(&userId); err != nil {
+			log.Println("Error reading rows: " + err.Error())
+			return nil, err
+		}
+
+		subscribers = append(subscribers, userId)
+	}
+
+	return subscribers, nil
+}
+
+/**
+ * Return the ids of the public hotspots owned by a user
+ */
+func getOwnedPublicHotspots(userId string) ([]string, error) {
+
+	var ids []string
+
+	db := db.DB_GetConnection()
+
+	if db == nil {
+		log.Println("Error: database not available")
+		return nil, errors.New("database not available")
+	}
+
+	rows, err := db.Query(`SELECT id FROM hn.HOTSPOTS WHERE owner = $1 AND private = false`, userId)
+
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+
+		if err := rows.Scan(&id); err != nil {
+			log.Println("Error reading rows: " + err.Error())
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+/**
+ * Return owner and private flag of a hotspot. Hotspots not in the database (ephemeral
+ * or not created yet) are public.
+ */
+func getHotspotVisibility(id string) (string, bool, error) {
+	var (
+		owner   string
+		private bool
+	)
+
+	db := db.DB_GetConnection()
+
+	if db == nil {
+		return owner, private, errors.New("database not available")
+	}
+
+	err := db.QueryRow(`SELECT owner, private FROM hn.HOTSPOTS WHERE id = $1`, id).Scan(&owner, &private)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+
+	return owner, private, err
+}
@@ -9,6 +9,7 @@ import (
 
 	"ekhoes-server/common"
 	"ekhoes-server/module"
+	"ekhoes-server/websocket"
 )
 
 //go:embed sql
@@ -28,11 +29,13 @@ var thisModule common.Module
 
 func Register() {
 	thisModule = common.Module{
-		Id:        "hnw",
-		Name:      "HereNow",
-		InitFunc:  Init,
-		Install:   Install,
-		WsHandler: WsHandler,
+		Id:           "hnw",
+		Name:         "HereNow",
+		InitFunc:     Init,
+		Install:      Install,
+		Router:       newRouter(),
+		RateLimit:    &common.RateLimit{Rate: 5, Burst: 10}, // Every query hits PostGIS
+		CanSubscribe: canSubscribe,
 	}
 	module.Register(thisModule)
 }
@@ -43,6 +46,8 @@ func Init(r *chi.Mux) error {
 
 	root := fmt.Sprintf("/%s", thisModule.Id)
 
+	websocket.OnPresence(publishOwnerPresence)
+
 	r.Route(root, func(r chi.Router) {
 		r.Post("/welcome", WelcomeHandler)
 		r.Post("/login", Login)
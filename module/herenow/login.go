@@ -19,9 +19,9 @@ import (
  */
 func Login(w http.ResponseWriter, r *http.Request) {
 	var (
-		credentials    auth.Credentials
-		user           auth.User
-		password_match bool = false
+		credentials auth.Credentials
+		user        auth.User
+		stored      sql.NullString
 	)
 
 	err := json.NewDecoder(r.Body).Decode(&credentials)
@@ -41,7 +41,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		rows, err := conn.Query(query, credentials.Password, credentials.Email)
+		rows, err := conn.Query(query, credentials.Email)
 
 		if errors.Is(err, sql.ErrNoRows) {
 			http.Error(w, "User not found", http.StatusUnauthorized)
@@ -50,14 +50,10 @@ func Login(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		defer rows.Close()
 
 		for rows.Next() {
-			_ = rows.Scan(&user.Id, &user.Name, &password_match)
-
-			if !password_match {
-				http.Error(w, "Wrong password", http.StatusUnauthorized)
-				return
-			}
+			_ = rows.Scan(&user.Id, &user.Name, &stored)
 		}
 
 		if user.Id == "" {
@@ -65,6 +61,24 @@ func Login(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		match, rehash, err := auth.VerifyPassword(stored.String, credentials.Password)
+
+		if err != nil {
+			utils.Err(err)
+			http.Error(w, "Wrong password", http.StatusUnauthorized)
+			return
+		}
+
+		if !match {
+			http.Error(w, "Wrong password", http.StatusUnauthorized)
+			return
+		}
+
+		// Legacy plain text or outdated hash
+		if rehash {
+			auth.RehashPassword(SqlFS, user.Id, credentials.Password)
+		}
+
 		// Create session
 
 		user.Email = credentials.Email
@@ -86,7 +100,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Create token
+		// Create tokens
 
 		claims := auth.CustomClaims{
 			SessionId: sessionId,
@@ -97,7 +111,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 			IsGuest:   false,
 		}
 
-		token, err := auth.GenerateJWT(claims, time.Time{})
+		tokens, err := auth.IssueTokens(thisModule.Id, claims)
 
 		if err != nil {
 			log.Println(err)
@@ -107,7 +121,8 @@ func Login(w http.ResponseWriter, r *http.Request) {
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf(`{"token":"%s", "name":"%s", "id":"%s" }`, token, user.Name, user.Id)))
+		w.Write([]byte(fmt.Sprintf(`{"token":"%s", "refreshToken":"%s", "expiresAt":"%s", "name":"%s", "id":"%s" }`,
+			tokens.Token, tokens.RefreshToken, tokens.ExpiresAt.Format(time.RFC3339), user.Name, user.Id)))
 
 		utils.Log("%s successfully authenticated\n", credentials.Email)
 	} else {
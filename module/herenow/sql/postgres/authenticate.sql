@@ -1,10 +1,10 @@
 SELECT 
 	u.id,
 	u.name,
-	(u.password = crypt($1, u.password)) AS password_match
+	u.password
 FROM 
 	hn.users u
 WHERE 
-	LOWER(u.email) = LOWER($2)
+	LOWER(u.email) = LOWER($1)
 	AND u.status = 'enabled'
 
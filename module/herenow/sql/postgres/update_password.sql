@@ -0,0 +1 @@
+UPDATE hn.users SET password = $1, updated = NOW() WHERE id = $2;
@@ -3,7 +3,6 @@ package herenow
 import (
 	"ekhoes-server/auth"
 	"ekhoes-server/common"
-	"ekhoes-server/utils"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,46 +13,57 @@ type Query struct {
 	Boundaries Boundaries `json:"boundaries"`
 }
 
-func WsHandler(user auth.User, in common.Message, out *common.Message) error {
+func (q Query) Validate() error {
+	if q.Id == "" {
+		return errors.New("missing query id")
+	}
 
-	utils.Debug("Received message of type '%s': %s\n", in.Type, in.Payload)
+	return nil
+}
 
-	switch in.Type {
-	case "query":
+func (b Boundaries) Validate() error {
+	for _, l := range []Location{b.NorthEast, b.SouthWest} {
+		if l.Latitude < -90 || l.Latitude > 90 || l.Longitude < -180 || l.Longitude > 180 {
+			return errors.New("boundaries out of range")
+		}
+	}
 
-		var query Query
+	return nil
+}
 
-		err := json.Unmarshal(in.Payload, &query)
+// Websocket messages handled by the module
+func newRouter() *common.Router {
+	r := common.NewRouter()
 
-		if err != nil {
-			return err
-		}
+	common.On(r, "query", handleQuery)
 
-		switch query.Id {
-		case "getHotspotsByBoundaries":
-			out.Type = "array"
+	return r
+}
 
-			//fmt.Printf("%+v\n", query.Boundaries)
+func handleQuery(user auth.User, query Query, out *common.Message) error {
+	var err error
 
-			hotspots := getHotspotsInBoundaries(user.Id, query.Boundaries)
-			ephemerals := getEphemeralHotspots()
-			hotspots = append(hotspots, ephemerals...)
+	switch query.Id {
+	case "getHotspotsByBoundaries":
+		if err := query.Boundaries.Validate(); err != nil {
+			return common.NewError(common.ErrBadRequest, err.Error())
+		}
 
-			out.Payload, err = json.Marshal(hotspots)
-			if err != nil {
-				return err
-			}
+		out.Type = "array"
 
-		default:
-			e := fmt.Sprintf("Unespected query: %s\n", query.Id)
-			return errors.New(e)
+		hotspots := getHotspotsInBoundaries(user.Id, query.Boundaries)
+		ephemerals := getEphemeralHotspots()
+		hotspots = append(hotspots, ephemerals...)
+
+		out.Payload, err = json.Marshal(hotspots)
+		if err != nil {
+			return err
 		}
 
 		//fmt.Printf("Hotspots found: %d\n", len(hotspots))
 
 	default:
-		e := fmt.Sprintf("Unespected type: %s\n", in.Type)
-		return errors.New(e)
+		return common.NewError(common.ErrUnsupported, fmt.Sprintf("unexpected query: %s", query.Id))
 	}
 
 	return nil
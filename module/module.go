@@ -1,6 +1,7 @@
 package module
 
 import (
+	"ekhoes-server/auth"
 	"ekhoes-server/common"
 	"fmt"
 	"log"
@@ -12,7 +13,7 @@ import (
 
 // var modules map[string]Module
 var modules = make(map[string]common.Module)
-var loaded []string
+var loaded []common.Module
 
 /*
 func init() {
@@ -58,13 +59,27 @@ func InitModules(r *chi.Mux) {
 
 		if success {
 			fmt.Println("OK")
-			loaded = append(loaded, m.Name)
+			loaded = append(loaded, m)
+
+			// Tokens are issued per module
+			auth.RegisterAudience(m.Id)
 		}
 	}
 }
 
 func GetLoadedModules() string {
-	return strings.Join(loaded, ",")
+	names := make([]string, 0, len(loaded))
+
+	for _, m := range loaded {
+		names = append(names, m.Name)
+	}
+
+	return strings.Join(names, ",")
+}
+
+// GetLoaded returns the modules successfully initialized, in order
+func GetLoaded() []common.Module {
+	return loaded
 }
 
 func Register(m common.Module) {
@@ -6,10 +6,35 @@ import (
 	"net/http"
 )
 
+/**
+ * GET /metrics[?node=<instance>]
+ * Connection counts are cluster-wide, or of a single instance.
+ * They come from the per node counters: the route is public and never scans the registry.
+ * Instance names are host names, they are listed by the admin route GET /admin/ctl/ws only.
+ */
 func GetMetrics(w http.ResponseWriter, r *http.Request) {
 
+	node := r.URL.Query().Get("node")
+
+	nodes, err := websocket.GetClusterNodes()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	count := 0
+
+	for name, n := range nodes {
+		if node == "" || node == name {
+			count += n
+		}
+	}
+
 	metrics := map[string]interface{}{
-		"count": websocket.GetConnectionsCount(),
+		"count":     count,
+		"local":     websocket.GetConnectionsCount(),
+		"websocket": websocket.GetMetrics(),
 	}
 
 	w.WriteHeader(http.StatusOK)
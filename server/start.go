@@ -12,6 +12,7 @@ import (
 	"ekhoes-server/config"
 	"ekhoes-server/db"
 	"ekhoes-server/module"
+	"ekhoes-server/utils"
 
 	"ekhoes-server/websocket"
 
@@ -27,6 +28,12 @@ func DynamicCORSMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
 
+		if origin != "" && !config.OriginAllowed(origin, r.Host) {
+			utils.Error("Origin not allowed: %s %s %s", origin, r.Method, r.URL.Path)
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
 		if origin != "" {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
@@ -64,6 +71,13 @@ func Start() int {
 		log.Fatal(err)
 	}
 
+	if err := auth.LoadKeys(); err != nil {
+		log.Fatal(err)
+	}
+
+	websocket.StartBus()
+	websocket.StartRegistry()
+
 	r := chi.NewRouter()
 
 	r.Use(middleware.Logger)
@@ -71,6 +85,8 @@ func Start() int {
 
 	r.Get("/", GetRoot)
 	r.Post("/logout", auth.Logout)
+	r.Post("/auth/refresh", auth.RefreshHandler)
+	r.Get("/.well-known/jwks.json", auth.JWKSHandler)
 
 	// Websocket endpoint
 	r.Method("GET", "/ws", http.HandlerFunc(websocket.HandleConnection))
@@ -127,6 +143,14 @@ func Start() int {
 	//<-ctx.Done()
 	//log.Println("Termination signal received")
 
+	// A second signal kills the process without waiting for the drain
+	stop()
+
+	// Websocket clients are told to reconnect elsewhere, the HTTP API stays available meanwhile
+	log.Println("Draining websocket connections...")
+
+	websocket.Drain()
+
 	// Create a context for timeout
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -142,9 +166,8 @@ func Start() int {
 		}
 	}
 
-	log.Println("Closing websocket connections...")
-
-	websocket.DisconnectAll()
+	websocket.StopRegistry()
+	websocket.StopBus()
 
 	db.CloseStuff()
 
@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"ekhoes-server/auth"
+	"ekhoes-server/common"
+	"ekhoes-server/config"
+	"ekhoes-server/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	MissingToken = errors.New("missing token")
+	AuthRequired = errors.New("authentication required")
+)
+
+// Payload of auth and reauth messages
+type AuthRequest struct {
+	Token string `json:"token"`
+}
+
+// Payload of the replies to auth and reauth
+type AuthResponse struct {
+	ConnectionId string     `json:"connectionId"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"` // The connection is closed then, unless a reauth comes first
+}
+
+/**
+ * Wait for the auth message, sent as first frame by clients that don't put the token
+ * in the upgrade request (which ends up in access logs). Called before the writer is started.
+ */
+func readAuthMessage(wsConn *WebsocketConnection) (common.Message, string, error) {
+	var msg common.Message
+
+	wsConn.conn.SetReadDeadline(time.Now().Add(config.WS_AuthTimeout()))
+
+	_, p, err := wsConn.conn.ReadMessage()
+	if err != nil {
+		return msg, "", err
+	}
+
+	if err := wsConn.Decode(p, &msg); err != nil {
+		return msg, "", err
+	}
+
+	if msg.Type != "auth" {
+		return msg, "", AuthRequired
+	}
+
+	var req AuthRequest
+
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || req.Token == "" {
+		return msg, "", MissingToken
+	}
+
+	return msg, req.Token, nil
+}
+
+/**
+ * Close the connection when its token expires. Every reauth moves the deadline forward.
+ * Used only by the reading goroutine.
+ */
+func (c *WebsocketConnection) setExpiry(expiresAt time.Time) {
+	c.stopExpiry()
+
+	if expiresAt.IsZero() {
+		return
+	}
+
+	c.expiry = time.AfterFunc(time.Until(expiresAt), func() {
+		utils.Log("Token of %s expired, closing connection %s\n", c.Email, c.ConnectionId)
+		c.Close(websocket.ClosePolicyViolation /* 1008 */, "Token expired")
+	})
+}
+
+func (c *WebsocketConnection) stopExpiry() {
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+}
+
+func authResponse(wsConn *WebsocketConnection, expiresAt time.Time) json.RawMessage {
+	response := AuthResponse{ConnectionId: wsConn.ConnectionId}
+
+	if !expiresAt.IsZero() {
+		response.ExpiresAt = &expiresAt
+	}
+
+	payload, _ := json.Marshal(response)
+
+	return payload
+}
+
+/**
+ * Handle reauth messages: a refreshed token of the same session extends the life of the connection
+ */
+func handleReauth(wsConn *WebsocketConnection, in common.Message, out *common.Message) error {
+	var req AuthRequest
+
+	if err := json.Unmarshal(in.Payload, &req); err != nil || req.Token == "" {
+		return common.NewError(common.ErrBadRequest, MissingToken.Error())
+	}
+
+	sessionId, expiresAt, err := auth.VerifySessionToken(req.Token)
+
+	if errors.Is(err, auth.RevocationUnavailable) {
+		utils.Err(err)
+		return common.NewError(common.ErrInternal, "internal error")
+	} else if err != nil {
+		utils.Error("Reauthentication of connection %s failed: %s", wsConn.ConnectionId, err)
+		return common.NewError(common.ErrForbidden, "invalid token")
+	}
+
+	if sessionId != wsConn.SessionId {
+		return common.NewError(common.ErrForbidden, "token of another session")
+	}
+
+	if _, err := auth.GetSession(sessionId); err != nil {
+		return common.NewError(common.ErrForbidden, "session not found")
+	}
+
+	wsConn.setExpiry(expiresAt)
+
+	utils.Debug("Connection %s of %s reauthenticated", wsConn.ConnectionId, wsConn.Email)
+
+	out.Type = "reauthenticated"
+	out.Payload = authResponse(wsConn, expiresAt)
+
+	return nil
+}
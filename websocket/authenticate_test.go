@@ -0,0 +1,23 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"ekhoes-server/common"
+)
+
+func TestReauthInvalidToken(t *testing.T) {
+	payload, _ := json.Marshal(AuthRequest{Token: "not-a-token"})
+
+	var reply common.Message
+
+	err := handleReauth(testConnection("s1", "u1", 1), common.Message{Type: "reauth", Payload: payload}, &reply)
+
+	// The cause of the failure is logged, not sent to the client
+	var e *common.Error
+	if !errors.As(err, &e) || e.Code != common.ErrForbidden || e.Message != "invalid token" {
+		t.Errorf("error = %v, want %s invalid token", err, common.ErrForbidden)
+	}
+}
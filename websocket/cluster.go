@@ -0,0 +1,142 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync/atomic"
+
+	"ekhoes-server/common"
+	"ekhoes-server/config"
+	"ekhoes-server/db"
+	"ekhoes-server/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis channel shared by all the instances
+const busChannel = "ekhoes:ws:bus"
+
+// Message travelling on the cluster bus
+type busEnvelope struct {
+	Node    string         `json:"node"` // Sender instance, see config.InstanceName()
+	Kind    string         `json:"kind"` // connection, session, user, broadcast, topic
+	Target  string         `json:"target,omitempty"`
+	Message common.Message `json:"message"`
+	Close   *closeRequest  `json:"close,omitempty"` // Set to disconnect the targets instead of sending Message
+}
+
+type closeRequest struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+var (
+	bus       atomic.Pointer[redis.PubSub]
+	busCancel context.CancelFunc
+)
+
+// Without Redis every push stays in process
+func busEnabled() bool {
+	return bus.Load() != nil
+}
+
+/**
+ * Subscribe to the cluster bus, so that pushes, broadcasts and topic publishes
+ * made on other instances reach the connections of this one.
+ */
+func StartBus() {
+	if !config.RedisEnabled() || db.RedisGetConnection() == nil {
+		log.Println("Websocket cluster bus disabled, messages are delivered in process")
+		return
+	}
+
+	log.Printf("Joining websocket cluster bus as %s...\n", config.InstanceName())
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	pubsub := db.RedisGetConnection().Subscribe(ctx, busChannel)
+
+	// Wait for the subscription to be confirmed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		utils.Error("Can't subscribe to websocket cluster bus: %s", err)
+		pubsub.Close()
+		cancel()
+		return
+	}
+
+	bus.Store(pubsub)
+	busCancel = cancel
+
+	go func() {
+		// The channel is closed by StopBus(). go-redis reconnects by itself.
+		for m := range pubsub.Channel() {
+			var env busEnvelope
+
+			if err := json.Unmarshal([]byte(m.Payload), &env); err != nil {
+				utils.Error("Invalid message on websocket cluster bus: %s", err)
+				continue
+			}
+
+			if env.Node == config.InstanceName() {
+				continue
+			}
+
+			utils.Debug("Bus message from %s for %s %s", env.Node, env.Kind, env.Target)
+
+			if env.Close != nil {
+				disconnectLocal(env.Kind, env.Target, env.Close.Code, env.Close.Reason)
+				continue
+			}
+
+			deliverLocal(env.Kind, env.Target, env.Message)
+		}
+	}()
+}
+
+func StopBus() {
+	pubsub := bus.Swap(nil)
+
+	if pubsub == nil {
+		return
+	}
+
+	pubsub.Close()
+	busCancel()
+}
+
+// Forward a push to the other instances
+func publishOnBus(kind string, target string, msg common.Message) {
+	sendOnBus(busEnvelope{
+		Node:    config.InstanceName(),
+		Kind:    kind,
+		Target:  target,
+		Message: msg,
+	})
+}
+
+// Ask the other instances to close the target connections
+func publishCloseOnBus(kind string, target string, code int, reason string) {
+	sendOnBus(busEnvelope{
+		Node:   config.InstanceName(),
+		Kind:   kind,
+		Target: target,
+		Close:  &closeRequest{Code: code, Reason: reason},
+	})
+}
+
+func sendOnBus(env busEnvelope) {
+	if !busEnabled() {
+		return
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		utils.Err(err)
+		return
+	}
+
+	if err := db.RedisGetConnection().Publish(context.Background(), busChannel, data).Err(); err != nil {
+		utils.Error("Error publishing on websocket cluster bus: %s", err)
+	}
+}
@@ -0,0 +1,224 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"ekhoes-server/common"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes and decodes messages on the wire. It's negotiated per connection
+// through the Sec-WebSocket-Protocol header, JSON is used when the client asks for none.
+//
+// Module handlers always see the payload as JSON: binary codecs convert it on the way in and out.
+type Codec interface {
+	Subprotocol() string
+	FrameType() int // websocket.TextMessage or websocket.BinaryMessage
+	Encode(msg common.Message) ([]byte, error)
+	Decode(data []byte, msg *common.Message) error
+}
+
+// In order of preference
+var codecs = []Codec{
+	jsonCodec{},
+	msgpackCodec{},
+	cborCodec{},
+}
+
+func Subprotocols() []string {
+	list := make([]string, 0, len(codecs))
+
+	for _, c := range codecs {
+		list = append(list, c.Subprotocol())
+	}
+
+	return list
+}
+
+// Return the codec for the negotiated subprotocol, JSON if none
+func getCodec(subprotocol string) Codec {
+	for _, c := range codecs {
+		if c.Subprotocol() == subprotocol {
+			return c
+		}
+	}
+
+	return codecs[0]
+}
+
+/**
+ * JSON
+ */
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string { return "ekhoes.json" }
+func (jsonCodec) FrameType() int      { return websocket.TextMessage }
+
+func (jsonCodec) Encode(msg common.Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Decode(data []byte, msg *common.Message) error {
+	return json.Unmarshal(data, msg)
+}
+
+/**
+ * Binary codecs share the same layout, with a generic payload instead of raw JSON
+ */
+
+type binaryMessage struct {
+	Id      string      `msgpack:"id,omitempty" cbor:"id,omitempty"`
+	Seq     uint64      `msgpack:"seq,omitempty" cbor:"seq,omitempty"`
+	Epoch   string      `msgpack:"epoch,omitempty" cbor:"epoch,omitempty"`
+	AppId   string      `msgpack:"appId" cbor:"appId"`
+	Type    string      `msgpack:"type" cbor:"type"`
+	Topic   string      `msgpack:"topic,omitempty" cbor:"topic,omitempty"`
+	NoReply bool        `msgpack:"noReply,omitempty" cbor:"noReply,omitempty"`
+	Payload interface{} `msgpack:"payload" cbor:"payload"`
+}
+
+// Decode a JSON payload keeping integers as integers
+func payloadFromJSON(raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	var value interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return normalizeNumbers(value), nil
+}
+
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+	}
+
+	return value
+}
+
+func toBinaryMessage(msg common.Message) (binaryMessage, error) {
+	payload, err := payloadFromJSON(msg.Payload)
+
+	return binaryMessage{
+		Id:      msg.Id,
+		Seq:     msg.Seq,
+		Epoch:   msg.Epoch,
+		AppId:   msg.AppId,
+		Type:    msg.Type,
+		Topic:   msg.Topic,
+		NoReply: msg.NoReply,
+		Payload: payload,
+	}, err
+}
+
+func fromBinaryMessage(bin binaryMessage, msg *common.Message) error {
+	*msg = common.Message{
+		Id:      bin.Id,
+		Seq:     bin.Seq,
+		Epoch:   bin.Epoch,
+		AppId:   bin.AppId,
+		Type:    bin.Type,
+		Topic:   bin.Topic,
+		NoReply: bin.NoReply,
+	}
+
+	if bin.Payload == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(bin.Payload)
+	if err != nil {
+		return err
+	}
+
+	msg.Payload = payload
+
+	return nil
+}
+
+/**
+ * MessagePack
+ */
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Subprotocol() string { return "ekhoes.msgpack" }
+func (msgpackCodec) FrameType() int      { return websocket.BinaryMessage }
+
+func (msgpackCodec) Encode(msg common.Message) ([]byte, error) {
+	bin, err := toBinaryMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return msgpack.Marshal(bin)
+}
+
+func (msgpackCodec) Decode(data []byte, msg *common.Message) error {
+	var bin binaryMessage
+
+	if err := msgpack.Unmarshal(data, &bin); err != nil {
+		return err
+	}
+
+	return fromBinaryMessage(bin, msg)
+}
+
+/**
+ * CBOR
+ */
+
+// Maps must be decoded with string keys to be converted back to JSON
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+type cborCodec struct{}
+
+func (cborCodec) Subprotocol() string { return "ekhoes.cbor" }
+func (cborCodec) FrameType() int      { return websocket.BinaryMessage }
+
+func (cborCodec) Encode(msg common.Message) ([]byte, error) {
+	bin, err := toBinaryMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return cbor.Marshal(bin)
+}
+
+func (cborCodec) Decode(data []byte, msg *common.Message) error {
+	var bin binaryMessage
+
+	if err := cborDecMode.Unmarshal(data, &bin); err != nil {
+		return err
+	}
+
+	return fromBinaryMessage(bin, msg)
+}
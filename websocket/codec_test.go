@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"ekhoes-server/common"
+)
+
+// Decode raw JSON keeping integers as integers, to compare payloads whatever the key order and number format
+func canonicalJSON(t *testing.T, raw json.RawMessage) interface{} {
+	t.Helper()
+
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+
+	var value interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("invalid JSON %s: %v", raw, err)
+	}
+
+	return normalizeNumbers(value)
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	messages := []common.Message{
+		{AppId: "hnw", Type: "ping"},
+		{Id: "7", AppId: "hnw", Type: "subscribe", Payload: json.RawMessage(`{"topics":["hnw:bbox:u0","hnw:hotspot:42"]}`)},
+		{Seq: 42, Epoch: "01JC0000000000000000000000", AppId: "hnw", Type: "hotspotUpdated", Topic: "hnw:hotspot:42",
+			Payload: json.RawMessage(`{"id":"42","private":false,"likes":3,"position":{"latitude":45.4642,"longitude":9.19},"tags":[],"owner":null}`)},
+		{AppId: "admin", Type: "notice", NoReply: true, Payload: json.RawMessage(`"Maintenance at 10pm – à bientôt 👋"`)},
+		{AppId: "admin", Type: "numbers", Payload: json.RawMessage(`[0,-1,9007199254740993,1.5,-0.25,1e300]`)},
+		{AppId: "admin", Type: "flag", Payload: json.RawMessage(`true`)},
+	}
+
+	for _, codec := range codecs {
+		for _, msg := range messages {
+			t.Run(codec.Subprotocol()+"/"+msg.Type, func(t *testing.T) {
+				data, err := codec.Encode(msg)
+				if err != nil {
+					t.Fatalf("encode: %v", err)
+				}
+
+				var decoded common.Message
+
+				if err := codec.Decode(data, &decoded); err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+
+				want, got := msg, decoded
+				want.Payload, got.Payload = nil, nil
+
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("message = %+v, want %+v", got, want)
+				}
+
+				if p, w := canonicalJSON(t, decoded.Payload), canonicalJSON(t, msg.Payload); !reflect.DeepEqual(p, w) {
+					t.Errorf("payload = %s, want %s", decoded.Payload, msg.Payload)
+				}
+			})
+		}
+	}
+}
+
+func TestGetCodec(t *testing.T) {
+	tests := []struct {
+		subprotocol string
+		want        string
+	}{
+		{"", "ekhoes.json"},
+		{"ekhoes.json", "ekhoes.json"},
+		{"ekhoes.msgpack", "ekhoes.msgpack"},
+		{"ekhoes.cbor", "ekhoes.cbor"},
+		{"unknown", "ekhoes.json"},
+	}
+
+	for _, tt := range tests {
+		if got := getCodec(tt.subprotocol).Subprotocol(); got != tt.want {
+			t.Errorf("getCodec(%q) = %s, want %s", tt.subprotocol, got, tt.want)
+		}
+	}
+}
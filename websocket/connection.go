@@ -0,0 +1,252 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"ekhoes-server/common"
+	"ekhoes-server/config"
+	"ekhoes-server/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+const writeWait = 10 * time.Second
+
+// A close frame payload is at most 125 bytes, 2 of them for the code
+const maxCloseText = 123
+
+var (
+	ConnectionClosed = errors.New("connection closed")
+	SendQueueFull    = errors.New("send queue full")
+)
+
+type WebsocketConnection struct {
+	conn         *websocket.Conn // Written only by writePump(), read only by the handler goroutine
+	ConnectionId string          `json:"connectionId"`
+	SessionId    string          `json:"sessionId"`
+	UserId       string          `json:"userId"`
+	Name         string          `json:"name"`
+	Email        string          `json:"email"`
+	Created      time.Time       `json:"created"`
+	Codec        string          `json:"codec"`
+
+	privileges string // Of the session user
+
+	codec      Codec
+	limiter    *connLimiter        // Used only by the reading goroutine
+	send       chan common.Message // Outbound queue, drained by writePump()
+	overflow   []common.Message    // Queued after send while it's full, see Send()
+	overflowN  uint64              // Incremented every time the writer takes the overflow
+	overflowMu sync.Mutex
+	done       chan struct{} // Closed when the connection must be closed
+	closed     chan struct{} // Closed when writePump() has returned
+	closeOnce  sync.Once
+	closeCode  int
+	closeText  string
+
+	topics map[string]struct{} // Guarded by topicsMu
+	expiry *time.Timer         // Closes the connection when the token expires, see setExpiry()
+}
+
+func NewConnection(conn *websocket.Conn) *WebsocketConnection {
+	codec := getCodec(conn.Subprotocol())
+
+	return &WebsocketConnection{
+		conn:    conn,
+		Codec:   codec.Subprotocol(),
+		codec:   codec,
+		limiter: newConnLimiter(),
+		send:    make(chan common.Message, config.WS_SendQueueSize()),
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Decode an inbound frame with the negotiated codec
+func (c *WebsocketConnection) Decode(data []byte, msg *common.Message) error {
+	return c.codec.Decode(data, msg)
+}
+
+/**
+ * Send queues a message for the writer goroutine. It's safe for concurrent use and never blocks,
+ * so a slow client doesn't delay the other recipients of a broadcast. When the queue is full
+ * messages wait in an overflow list of the same size: a client still behind after
+ * WS_SendTimeout(), or filling the overflow too, is disconnected.
+ */
+func (c *WebsocketConnection) Send(msg common.Message) error {
+	select {
+	case <-c.done:
+		return ConnectionClosed
+	default:
+	}
+
+	c.overflowMu.Lock()
+	defer c.overflowMu.Unlock()
+
+	// Once something overflowed, everything goes after it to keep the order
+	if len(c.overflow) == 0 {
+		select {
+		case c.send <- msg:
+			return nil
+		default:
+		}
+
+		// Queue is full, give the writer some time to catch up
+		n := c.overflowN
+		time.AfterFunc(config.WS_SendTimeout(), func() {
+			c.overflowMu.Lock()
+			defer c.overflowMu.Unlock()
+
+			if c.overflowN == n && len(c.overflow) > 0 {
+				c.evict()
+			}
+		})
+	}
+
+	if len(c.overflow) >= cap(c.send) {
+		c.evict()
+		return SendQueueFull
+	}
+
+	c.overflow = append(c.overflow, msg)
+
+	return nil
+}
+
+// Disconnect a slow consumer. Must be called with overflowMu held.
+func (c *WebsocketConnection) evict() {
+	atomic.AddUint64(&metrics.SlowConsumers, 1)
+	utils.Error("Slow consumer, closing connection %s of %s", c.ConnectionId, c.Email)
+
+	c.overflow = nil
+	c.Close(websocket.CloseTryAgainLater /* 1013 */, "Send queue full")
+}
+
+// Write the messages queued after a full queue. Used only by writePump().
+func (c *WebsocketConnection) writeOverflow() error {
+	c.overflowMu.Lock()
+	list := c.overflow
+	c.overflow = nil
+	c.overflowN++
+	c.overflowMu.Unlock()
+
+	for _, msg := range list {
+		if err := c.write(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Cut text to fit a close frame, without splitting a UTF-8 sequence: clients reject invalid reasons
+func truncateCloseText(text string) string {
+	if len(text) <= maxCloseText {
+		return text
+	}
+
+	i := maxCloseText
+	for i > 0 && !utf8.RuneStart(text[i]) {
+		i--
+	}
+
+	return text[:i]
+}
+
+// Close asks the writer goroutine to flush the queue, send a close frame and close the connection
+func (c *WebsocketConnection) Close(code int, text string) {
+	text = truncateCloseText(text)
+
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeText = text
+		close(c.done)
+	})
+}
+
+func (c *WebsocketConnection) write(msg common.Message) error {
+	data, err := c.codec.Encode(msg)
+	if err != nil {
+		utils.Error("Error encoding message: %s", err)
+		return nil
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+	if err := c.conn.WriteMessage(c.codec.FrameType(), data); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&metrics.MessagesSent, 1)
+
+	return nil
+}
+
+/**
+ * The only goroutine allowed to write data frames on the connection. It also pings the client.
+ */
+func (c *WebsocketConnection) writePump() {
+	defer func() {
+		c.Close(websocket.CloseAbnormalClosure, "")
+		c.conn.Close()
+		close(c.closed)
+	}()
+
+	ticker := time.NewTicker(config.WS_PingInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-c.send:
+			if err := c.write(msg); err != nil {
+				utils.Error("Error writing message: %s", err)
+				return
+			}
+
+			// Caught up with the queue, the overflow comes next
+			if len(c.send) == 0 {
+				if err := c.writeOverflow(); err != nil {
+					utils.Error("Error writing message: %s", err)
+					return
+				}
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				utils.Error("Error writing ping: %s", err)
+				return
+			}
+
+		case <-c.done:
+			// Flush what's already queued, then say goodbye
+		flush:
+			for {
+				select {
+				case msg := <-c.send:
+					if err := c.write(msg); err != nil {
+						return
+					}
+				default:
+					break flush
+				}
+			}
+
+			if err := c.writeOverflow(); err != nil {
+				return
+			}
+
+			_ = c.conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.closeCode, c.closeText),
+				time.Now().Add(writeWait),
+			)
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ekhoes-server/common"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSendOverflow(t *testing.T) {
+	t.Setenv("EKHOES_WS_SEND_TIMEOUT", "60000")
+
+	wsConn := testConnection("s1", "u1", 2)
+	slow := atomic.LoadUint64(&metrics.SlowConsumers)
+
+	// Queue, then overflow, both of the same size
+	for i := 0; i < 4; i++ {
+		if err := wsConn.Send(common.Message{Type: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+
+	if len(wsConn.send) != 2 || len(wsConn.overflow) != 2 || isClosing(wsConn) {
+		t.Fatalf("queue %d, overflow %d, closing %v: want 2, 2, false", len(wsConn.send), len(wsConn.overflow), isClosing(wsConn))
+	}
+
+	// Once the overflow is full too, the consumer is evicted
+	if err := wsConn.Send(common.Message{Type: "4"}); !errors.Is(err, SendQueueFull) {
+		t.Fatalf("error = %v, want %v", err, SendQueueFull)
+	}
+
+	if !isClosing(wsConn) || wsConn.closeCode != websocket.CloseTryAgainLater {
+		t.Errorf("closing %v with code %d, want 1013", isClosing(wsConn), wsConn.closeCode)
+	}
+
+	if got := atomic.LoadUint64(&metrics.SlowConsumers) - slow; got != 1 {
+		t.Errorf("%d slow consumers counted, want 1", got)
+	}
+
+	if err := wsConn.Send(common.Message{Type: "5"}); !errors.Is(err, ConnectionClosed) {
+		t.Errorf("send after the eviction: error %v, want %v", err, ConnectionClosed)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	t.Setenv("EKHOES_WS_SEND_TIMEOUT", "20")
+
+	wsConn := testConnection("s1", "u1", 1)
+
+	wsConn.Send(common.Message{Type: "0"})
+	wsConn.Send(common.Message{Type: "1"}) // Overflows, nobody reads the queue
+
+	select {
+	case <-wsConn.done:
+	case <-time.After(time.Second):
+		t.Fatal("consumer still connected after the send timeout")
+	}
+
+	if wsConn.closeCode != websocket.CloseTryAgainLater {
+		t.Errorf("close code %d, want 1013", wsConn.closeCode)
+	}
+}
+
+// A writer catching up in time keeps the connection open and the messages in order
+func TestWritePumpDrainsOverflow(t *testing.T) {
+	t.Setenv("EKHOES_WS_SEND_TIMEOUT", "50")
+
+	accepted := make(chan *websocket.Conn, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}))
+	defer srv.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	wsConn := testConnection("s1", "u1", 2)
+	wsConn.conn = <-accepted
+
+	// Queued before the writer starts: 2 in the queue, 2 in the overflow
+	for i := 0; i < 4; i++ {
+		if err := wsConn.Send(common.Message{Type: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+
+	go wsConn.writePump()
+	defer wsConn.Close(websocket.CloseNormalClosure, "")
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+
+	for i := 0; i < 4; i++ {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+
+		var msg common.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type != fmt.Sprint(i) {
+			t.Fatalf("message %d has type %q", i, msg.Type)
+		}
+	}
+
+	// Past the send timeout, the connection is still there
+	time.Sleep(100 * time.Millisecond)
+
+	if isClosing(wsConn) {
+		t.Error("connection evicted after the writer caught up")
+	}
+}
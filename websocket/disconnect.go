@@ -0,0 +1,194 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"ekhoes-server/auth"
+	"ekhoes-server/utils"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+const defaultDisconnectReason = "Disconnected by an administrator"
+
+// Tokens of a revoked session can't be refreshed, close the sockets opened with them
+func init() {
+	auth.OnSessionRevoked(func(sessionId string) {
+		DisconnectSession(sessionId, "Session revoked")
+	})
+}
+
+// Close the matching connections of this instance and return how many they were
+func disconnectLocal(kind string, target string, code int, reason string) int {
+	var filter func(*WebsocketConnection) bool
+
+	switch kind {
+	case targetConnection:
+		filter = func(c *WebsocketConnection) bool { return c.ConnectionId == target }
+	case targetSession:
+		filter = func(c *WebsocketConnection) bool { return c.SessionId == target }
+	case targetUser:
+		filter = func(c *WebsocketConnection) bool { return c.UserId == target }
+	case targetBroadcast:
+		filter = nil
+	default:
+		return 0
+	}
+
+	list := findConnections(filter)
+
+	for _, wsConn := range list {
+		utils.Log("Closing connection %s of %s: %s\n", wsConn.ConnectionId, wsConn.Email, reason)
+		wsConn.Close(code, reason)
+	}
+
+	return len(list)
+}
+
+// The functions below close connections with code 1008 and the given reason, on every instance
+// of the cluster. They return the number of connections closed on this instance.
+
+// DisconnectConnection closes a single connection. Returns false if it isn't on this instance.
+func DisconnectConnection(connectionId string, reason string) bool {
+	if disconnectLocal(targetConnection, connectionId, websocket.ClosePolicyViolation, reason) > 0 {
+		return true
+	}
+
+	publishCloseOnBus(targetConnection, connectionId, websocket.ClosePolicyViolation, reason)
+
+	return false
+}
+
+// DisconnectSession closes every connection opened with the given session
+func DisconnectSession(sessionId string, reason string) int {
+	count := disconnectLocal(targetSession, sessionId, websocket.ClosePolicyViolation, reason)
+
+	publishCloseOnBus(targetSession, sessionId, websocket.ClosePolicyViolation, reason)
+
+	return count
+}
+
+// DisconnectUser closes every connection of the given user, whatever the session
+func DisconnectUser(userId string, reason string) int {
+	count := disconnectLocal(targetUser, userId, websocket.ClosePolicyViolation, reason)
+
+	publishCloseOnBus(targetUser, userId, websocket.ClosePolicyViolation, reason)
+
+	return count
+}
+
+// DisconnectEveryone closes every client connection, e.g. when all the sessions are deleted
+func DisconnectEveryone(reason string) int {
+	count := disconnectLocal(targetBroadcast, "", websocket.ClosePolicyViolation, reason)
+
+	publishCloseOnBus(targetBroadcast, "", websocket.ClosePolicyViolation, reason)
+
+	return count
+}
+
+// Count the registered connections matching filter, on the whole cluster
+func countClusterConnections(filter func(ConnectionEntry) bool) (int, error) {
+	list, err := GetClusterConnections("")
+
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for _, entry := range list {
+		if filter(entry) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func checkDeletePrivilege(w http.ResponseWriter, r *http.Request) bool {
+	claims, err := auth.CheckAuthorization(r, adminAudience)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+
+	if auth.HasPrivilege(claims.Privileges, "ek_delete_websocket") == false {
+		http.Error(w, "missing required privileges", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+func disconnectReason(r *http.Request) string {
+	if reason := r.URL.Query().Get("reason"); reason != "" {
+		return reason
+	}
+
+	return defaultDisconnectReason
+}
+
+/**
+ * DELETE /ws/{connectionId}[?reason=<text>]
+ */
+func DisconnectConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkDeletePrivilege(w, r) {
+		return
+	}
+
+	connectionId := chi.URLParam(r, "connectionId")
+
+	count, err := countClusterConnections(func(e ConnectionEntry) bool {
+		return e.ConnectionId == connectionId
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if count == 0 {
+		http.Error(w, "connection not found", http.StatusNotFound)
+		return
+	}
+
+	DisconnectConnection(connectionId, disconnectReason(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int{"disconnected": count})
+}
+
+/**
+ * DELETE /ws?user=<id>[&reason=<text>]
+ */
+func DisconnectUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkDeletePrivilege(w, r) {
+		return
+	}
+
+	userId := r.URL.Query().Get("user")
+
+	if userId == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return
+	}
+
+	count, err := countClusterConnections(func(e ConnectionEntry) bool {
+		return e.UserId == userId
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	DisconnectUser(userId, disconnectReason(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int{"disconnected": count})
+}
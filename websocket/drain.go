@@ -0,0 +1,77 @@
+package websocket
+
+import (
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"ekhoes-server/common"
+	"ekhoes-server/config"
+	"ekhoes-server/utils"
+)
+
+const drainPollInterval = 100 * time.Millisecond
+
+// Payload of the server_shutdown message
+type ShutdownNotice struct {
+	ReconnectDelay int64 `json:"reconnectDelay"` // Milliseconds to wait before reconnecting, jitter included
+	Grace          int64 `json:"grace"`          // Seconds before the connection is closed by the server
+}
+
+func isDraining() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return draining
+}
+
+/**
+ * Drain stops accepting connections, asks the clients to reconnect elsewhere with a
+ * server_shutdown message and waits up to WS_DrainGrace() for them to leave.
+ * The connections still open after that are closed with 1012.
+ */
+func Drain() {
+	grace := config.WS_DrainGrace()
+	delay := config.WS_ReconnectDelay()
+	jitter := config.WS_ReconnectJitter()
+
+	// From now on AddConnection() fails, so the list below is complete
+	mu.Lock()
+	draining = true
+
+	list := make([]*WebsocketConnection, 0, total)
+	for _, sessionMap := range connections {
+		for _, wsConn := range sessionMap {
+			list = append(list, wsConn)
+		}
+	}
+	mu.Unlock()
+
+	utils.Log("Draining %d websocket connections...\n", len(list))
+
+	for _, wsConn := range list {
+		reconnect := delay
+		if jitter > 0 {
+			reconnect += time.Duration(rand.Int63n(int64(jitter)))
+		}
+
+		payload, _ := json.Marshal(ShutdownNotice{
+			ReconnectDelay: reconnect.Milliseconds(),
+			Grace:          int64(grace.Seconds()),
+		})
+
+		wsConn.Send(common.Message{Type: "server_shutdown", Payload: payload})
+	}
+
+	deadline := time.Now().Add(grace)
+
+	for GetConnectionsCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+
+	if count := GetConnectionsCount(); count > 0 {
+		utils.Log("Closing %d websocket connections still open\n", count)
+	}
+
+	DisconnectAll()
+}
@@ -2,13 +2,19 @@ package websocket
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"log"
 
 	"ekhoes-server/auth"
 	"ekhoes-server/common"
+	"ekhoes-server/config"
 	"ekhoes-server/module"
 	"ekhoes-server/utils"
 
@@ -17,12 +23,37 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-// Struttura per il WebSocket
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// Permetti connessioni da qualsiasi origine
+var (
+	upgrader     *websocket.Upgrader
+	upgraderOnce sync.Once
+)
+
+// Built on first use, when the configuration has been loaded
+func getUpgrader() *websocket.Upgrader {
+	upgraderOnce.Do(func() {
+		upgrader = &websocket.Upgrader{
+			ReadBufferSize:    config.WS_ReadBufferSize(),
+			WriteBufferSize:   config.WS_WriteBufferSize(),
+			EnableCompression: config.WS_Compression(),
+			Subprotocols:      Subprotocols(),
+			CheckOrigin:       checkOrigin,
+		}
+	})
+
+	return upgrader
+}
+
+// Browsers always send Origin, other clients (mobile apps, cli) usually don't
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	if origin == "" || config.OriginAllowed(origin, r.Host) {
 		return true
-	},
+	}
+
+	utils.Error("Websocket upgrade rejected, origin not allowed: %s from %s", origin, r.RemoteAddr)
+
+	return false
 }
 
 func closeOnError(conn *websocket.Conn, code int, message string) {
@@ -30,7 +61,7 @@ func closeOnError(conn *websocket.Conn, code int, message string) {
 		websocket.CloseMessage,
 		websocket.FormatCloseMessage(
 			code,
-			message,
+			truncateCloseText(message),
 		),
 	)
 	conn.Close()
@@ -49,18 +80,34 @@ func HandleConnection(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("===== END REQUEST =====")
 	*/
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Send clients to the other instances while shutting down
+	if isDraining() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, ServerShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := getUpgrader().Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("Error upgrading WebSocket:", err)
 		return
 	}
 
-	token := ""
-	wsConn := WebsocketConnection{
-		Conn: conn,
+	// Larger messages are rejected by gorilla with close code 1009
+	conn.SetReadLimit(config.WS_MaxMessageSize())
+
+	if config.WS_Compression() {
+		if err := conn.SetCompressionLevel(config.WS_CompressionLevel()); err != nil {
+			utils.Err(err)
+		}
 	}
 
-	// Check if user has a token (cookie or query parameter)
+	token := ""
+	wsConn := NewConnection(conn)
+
+	// Check if user has a token (cookie or query parameter), otherwise it must come with the first message
+
+	var authMsg *common.Message
 
 	cookie, err := r.Cookie("cookie-ekhoes")
 	if err == nil {
@@ -72,48 +119,108 @@ func HandleConnection(w http.ResponseWriter, r *http.Request) {
 	//fmt.Println("token:", token)
 
 	if token == "" {
-		utils.Error("Missing token")
-		closeOnError(conn, websocket.ClosePolicyViolation /* 1008 */, "Missing token")
-		return
+		msg, t, err := readAuthMessage(wsConn)
+
+		if err != nil {
+			utils.Error("Websocket authentication failed: %s", err)
+			closeOnError(conn, websocket.ClosePolicyViolation /* 1008 */, AuthRequired.Error())
+			return
+		}
+
+		token = t
+		authMsg = &msg
 	}
 
-	wsConn.SessionId, err = auth.VerifyJWT(token)
+	var expiresAt time.Time
 
-	if err != nil {
+	wsConn.SessionId, expiresAt, err = auth.VerifySessionToken(token)
+
+	// The reason is fixed, the details only go to the log
+	if errors.Is(err, auth.RevocationUnavailable) {
+		utils.Err(err)
+		closeOnError(conn, websocket.CloseInternalServerErr /* 1011 */, "Internal error")
+		return
+	} else if err != nil {
 		utils.Err(err)
-		closeOnError(conn, websocket.ClosePolicyViolation /* 1008 */, err.Error())
+		closeOnError(conn, websocket.ClosePolicyViolation /* 1008 */, "Invalid token")
 		return
 	}
 
-	sess, found := auth.SetSessionActive(wsConn.SessionId, true)
+	sess, err := auth.GetSession(wsConn.SessionId)
 
-	if !found {
+	if err != nil {
 		utils.Error("Session not found in websocket connection handler: %s\n", wsConn.SessionId)
 		closeOnError(conn, websocket.ClosePolicyViolation /* 1008 */, "Session not found")
 		return
 	}
 
+	wsConn.UserId = sess.User.Id
 	wsConn.Name = sess.User.Name
 	wsConn.Email = sess.User.Email
+	wsConn.privileges = sess.User.Privileges
 
-	utils.Log("Connected %s %s\n", wsConn.Name, wsConn.Email)
+	// Liveness: the writer pings the client, every pong (or message) pushes the read deadline forward.
+	// A dead peer makes ReadMessage() time out and the connection gets reaped by onDisconnect().
+
+	pongTimeout := config.WS_PongTimeout()
+
+	conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+
+	// Register the connection, start the writer and replay what the client missed
+	if err := connect(wsConn, r.URL.Query().Get("resume")); err != nil {
+		utils.Error("Connection of %s rejected: %s", wsConn.Email, err)
+
+		code := websocket.ClosePolicyViolation /* 1008 */
+		if err == TooManyConnections {
+			code = websocket.CloseTryAgainLater /* 1013 */
+		} else if err == ServerShuttingDown {
+			code = websocket.CloseServiceRestart /* 1012 */
+		}
+
+		closeOnError(conn, code, err.Error())
+		return
+	}
+
+	registerConnection(wsConn)
+	auth.SetSessionActive(wsConn.SessionId, true)
+
+	wsConn.setExpiry(expiresAt)
+
+	if authMsg != nil {
+		wsConn.Send(common.Message{Id: authMsg.Id, AppId: authMsg.AppId, Type: "authenticated", Payload: authResponse(wsConn, expiresAt)})
+	}
 
-	AddConnection(&wsConn)
+	utils.Log("Connected %s %s\n", wsConn.Name, wsConn.Email)
 
 	defer func() {
 		utils.Log("Disconnected %s %s\n", wsConn.Name, wsConn.Email)
-		onDisconnect(&wsConn)
+		onDisconnect(wsConn)
 	}()
 
+	first := true
+
 	for {
 
-		// Read message (messageType is an int with value websocket.BinaryMessage or websocket.TextMessage)
+		// Read message (messageType is an int with value websocket.BinaryMessage or websocket.TextMessage).
+		// Both are decoded with the codec negotiated at upgrade.
 
 		_, p, err := conn.ReadMessage()
 
 		if err != nil {
+			var netErr net.Error
+
 			if websocket.IsCloseError(err, websocket.CloseGoingAway) {
 				//fmt.Println("Client ha chiuso la connessione (going away)")
+			} else if errors.Is(err, websocket.ErrReadLimit) {
+				// The 1009 close frame has already been sent by gorilla, only the clean up is left
+				atomic.AddUint64(&metrics.OversizedMessages, 1)
+				utils.Error("Message from %s exceeds %d bytes, closing connection %s", wsConn.Email, config.WS_MaxMessageSize(), wsConn.ConnectionId)
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				atomic.AddUint64(&metrics.Timeouts, 1)
+				utils.Log("Connection %s of %s timed out\n", wsConn.ConnectionId, wsConn.Email)
 			} else if websocket.IsUnexpectedCloseError(err) {
 				utils.Error("Error reading message: %s", err)
 			}
@@ -121,64 +228,60 @@ func HandleConnection(w http.ResponseWriter, r *http.Request) {
 		}
 		//fmt.Println(string(p))
 
-		// Unmarshal message
+		conn.SetReadDeadline(time.Now().Add(pongTimeout))
+
+		// Decode message
 
 		var msg common.Message
 
-		err = json.Unmarshal(p, &msg)
+		err = wsConn.Decode(p, &msg)
 
 		if err != nil {
-			log.Println("Error unmarshalling message:", err)
+			log.Println("Error decoding message:", err)
+			wsConn.Send(common.ErrorMessage(msg, common.NewError(common.ErrBadRequest, "malformed message")))
 			continue
 		}
 
-		// Process message
-
-		reply := common.Message{
-			AppId: msg.AppId,
+		if err := checkRateLimit(wsConn, msg); err != nil {
+			wsConn.Send(common.ErrorMessage(msg, err))
+			continue
 		}
 
-		m, ok := module.GetModule(msg.AppId)
-
-		if ok {
-			// Module handler
+		// Handshake
 
-			err := m.WsHandler(sess.User, msg, &reply)
+		if first {
+			first = false
 
-			if err != nil {
-				log.Printf("[%s] Error processing websocket message: %s", m.Name, err)
+			if err := handshake(wsConn, msg); err != nil {
+				break
 			}
-		} else {
-			// Fallback
-
-			if msg.Type == "ping" {
-				now := time.Now().UTC()
-				isoString := now.Format(time.RFC3339)
-				payload, _ := json.Marshal(isoString)
-				reply = common.Message{Type: "pong", Payload: payload}
-
-				jsonStr, _ := json.Marshal(reply)
-
-				if err := conn.WriteMessage(websocket.TextMessage, []byte(jsonStr)); err != nil {
-					log.Println("Error writing message:", err)
-					break
-				}
-			} else {
-				log.Printf("Unhandled message from app '%s' %v\n", msg.AppId, msg)
-				//reply = Message{Type: "default", Text: "Hello from websocket server"}
+
+			if msg.Type == "hello" {
+				continue
 			}
+		} else if msg.Type == "hello" {
+			wsConn.Send(common.ErrorMessage(msg, common.NewError(common.ErrBadRequest, "hello must be the first message")))
+			continue
 		}
 
-		replyBytes, err := json.Marshal(reply)
+		// Process message
+
+		reply, err := processMessage(wsConn, sess.User, msg)
 
 		if err != nil {
-			log.Println("Error unmarshalling message:", err)
+			utils.Error("[%s] Error processing websocket message of type '%s': %s", msg.AppId, msg.Type, err)
+			reply = common.ErrorMessage(msg, err)
+		}
+
+		if msg.NoReply {
 			continue
 		}
 
-		utils.Debug("Replying... %s", string(replyBytes))
+		reply.Id = msg.Id
+
+		utils.Debug("Replying... %+v", reply)
 
-		if err := conn.WriteMessage(websocket.TextMessage, replyBytes); err != nil {
+		if err := wsConn.Send(reply); err != nil {
 			utils.Error("Error writing message: %s", err.Error())
 			break
 		}
@@ -186,24 +289,119 @@ func HandleConnection(w http.ResponseWriter, r *http.Request) {
 }
 
 /**
- * GET /ws
+ * Route a message to the server or to its module and return the reply
+ */
+func processMessage(wsConn *WebsocketConnection, user auth.User, msg common.Message) (common.Message, error) {
+	reply := common.Message{
+		AppId: msg.AppId,
+	}
+
+	// Server message types (see serverMessageTypes) are handled for every app, before any module
+	if msg.Type == "ping" {
+		now := time.Now().UTC()
+		isoString := now.Format(time.RFC3339)
+		payload, _ := json.Marshal(isoString)
+		reply = common.Message{Type: "pong", Payload: payload}
+
+		return reply, nil
+	}
+
+	if msg.Type == "subscribe" || msg.Type == "unsubscribe" {
+		err := handleTopicMessage(wsConn, user, msg, &reply)
+		return reply, err
+	}
+
+	if msg.Type == "reauth" || msg.Type == "auth" {
+		err := handleReauth(wsConn, msg, &reply)
+		return reply, err
+	}
+
+	if msg.Type == "presence" {
+		err := handlePresenceQuery(user, msg, &reply)
+		return reply, err
+	}
+
+	m, ok := module.GetModule(msg.AppId)
+
+	if ok {
+		utils.Debug("[%s] Received message of type '%s': %s", msg.AppId, msg.Type, msg.Payload)
+
+		// Same privileges and roles as the HTTP side, checked before any module code runs
+		if !m.Permission(msg.Type).Allowed(user) {
+			atomic.AddUint64(&metrics.ForbiddenMessages, 1)
+			utils.Error("[%s] Message of type '%s' from %s denied", msg.AppId, msg.Type, user.Email)
+			return reply, common.NewError(common.ErrForbidden, fmt.Sprintf("not allowed to send '%s'", msg.Type))
+		}
+	}
+
+	if ok && m.Router != nil {
+		err := m.Router.Dispatch(user, msg, &reply)
+		return reply, err
+	}
+
+	if ok && m.WsHandler != nil {
+		// Module handler
+		err := m.WsHandler(user, msg, &reply)
+		return reply, err
+	}
+
+	log.Printf("Unhandled message from app '%s' %v\n", msg.AppId, msg)
+
+	return reply, common.NewError(common.ErrUnsupported, fmt.Sprintf("no handler for app '%s'", msg.AppId))
+}
+
+// The operator routes of this package are mounted by the admin module under /admin/ctl
+// and accept its tokens only
+const adminAudience = "admin"
+
+/**
+ * GET /ws[?node=<instance>]
+ * Connections of the whole cluster, or of a single instance
  */
 func GetConnectionsHandler(w http.ResponseWriter, r *http.Request) {
-	claims, err := auth.CheckAuthorization(r)
+	claims, err := auth.CheckAuthorization(r, adminAudience)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	if auth.HasPrivilege(claims["privileges"].(string), "ek_read_websocket") == false {
+	if auth.HasPrivilege(claims.Privileges, "ek_read_websocket") == false {
 		http.Error(w, "missing required privileges", http.StatusUnauthorized)
 		return
 	}
 
-	connections := GetConnections()
+	type Response struct {
+		Node        string            `json:"node"` // This instance
+		Limits      ConnectionLimits  `json:"limits"`
+		Count       int               `json:"count"`
+		Nodes       map[string]int    `json:"nodes"`
+		Connections []ConnectionEntry `json:"connections"`
+	}
+
+	list, err := GetClusterConnections(r.URL.Query().Get("node"))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nodes, err := GetClusterNodes()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{
+		Node:        config.InstanceName(),
+		Limits:      GetConnectionLimits(),
+		Count:       len(list),
+		Nodes:       nodes,
+		Connections: list,
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(connections)
+	json.NewEncoder(w).Encode(response)
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,27 @@
+package websocket
+
+import (
+	"testing"
+
+	"ekhoes-server/auth"
+	"ekhoes-server/common"
+	"ekhoes-server/module"
+)
+
+func TestPingWithAnyAppId(t *testing.T) {
+	// A module handling every message type must not shadow the server ones
+	module.Register(common.Module{
+		Id: "pingtest",
+		WsHandler: func(user auth.User, in common.Message, out *common.Message) error {
+			return common.NewError(common.ErrUnsupported, "unsupported")
+		},
+	})
+
+	for _, appId := range []string{"pingtest", "unknown", ""} {
+		reply, err := processMessage(testConnection("s1", "u1", 1), auth.User{Id: "u1"}, common.Message{AppId: appId, Type: "ping"})
+
+		if err != nil || reply.Type != "pong" {
+			t.Errorf("ping with appId %q: reply %q, error %v", appId, reply.Type, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"ekhoes-server/common"
+	"ekhoes-server/config"
+	"ekhoes-server/module"
+	"ekhoes-server/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// Version of the message protocol, bumped on incompatible changes
+const ProtocolVersion = 1
+
+var supportedVersions = []int{1}
+
+// Handled by the server for every app
+var serverMessageTypes = []string{"hello", "auth", "reauth", "ping", "subscribe", "unsubscribe", "presence"}
+
+var (
+	UnsupportedVersion = errors.New("unsupported protocol version")
+	HelloExpected      = errors.New("hello expected")
+)
+
+// Payload of the hello sent by clients
+type HelloRequest struct {
+	Version int    `json:"version"`
+	Client  string `json:"client,omitempty"` // Free text, e.g. "ios/2.3.1", only logged
+}
+
+type ModuleInfo struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name"`
+	MessageTypes []string `json:"messageTypes"`
+}
+
+type HelloLimits struct {
+	MaxMessageSize int64 `json:"maxMessageSize"` // Bytes
+	Heartbeat      int64 `json:"heartbeat"`      // Seconds between server pings
+	PongTimeout    int64 `json:"pongTimeout"`    // Seconds of silence after which the connection is dropped
+}
+
+// Payload of the hello sent back by the server
+type HelloResponse struct {
+	Protocol     int          `json:"protocol"`
+	Server       string       `json:"server"`
+	Version      string       `json:"version"`
+	Instance     string       `json:"instance"`
+	ConnectionId string       `json:"connectionId"`
+	Codec        string       `json:"codec"`
+	MessageTypes []string     `json:"messageTypes"` // Accepted with any appId
+	Modules      []ModuleInfo `json:"modules"`
+	Limits       HelloLimits  `json:"limits"`
+}
+
+func getModulesInfo() []ModuleInfo {
+	list := []ModuleInfo{}
+
+	for _, m := range module.GetLoaded() {
+		types := m.MessageTypes
+		if m.Router != nil {
+			types = m.Router.Types()
+		}
+		if types == nil {
+			types = []string{}
+		}
+
+		list = append(list, ModuleInfo{Id: m.Id, Name: m.Name, MessageTypes: types})
+	}
+
+	return list
+}
+
+// Send an error to the client and close the connection with 1002
+func rejectHandshake(wsConn *WebsocketConnection, msg common.Message, err error, text string) error {
+	utils.Error("Handshake of %s rejected: %s", wsConn.Email, text)
+
+	wsConn.Send(common.ErrorMessage(msg, common.NewError(common.ErrUnsupported, text)))
+	wsConn.Close(websocket.CloseProtocolError /* 1002 */, text)
+
+	return err
+}
+
+/**
+ * Handle the first frame of a connection. A hello gets the server capabilities as reply,
+ * other messages are let through unless WS_RequireHello() is set. An error means the
+ * connection is being closed.
+ */
+func handshake(wsConn *WebsocketConnection, msg common.Message) error {
+	if msg.Type != "hello" {
+		if config.WS_RequireHello() {
+			return rejectHandshake(wsConn, msg, HelloExpected, "Expected hello as first message")
+		}
+		return nil
+	}
+
+	var req HelloRequest
+
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			return rejectHandshake(wsConn, msg, err, "Malformed hello")
+		}
+	}
+
+	if !slices.Contains(supportedVersions, req.Version) {
+		return rejectHandshake(wsConn, msg, UnsupportedVersion,
+			fmt.Sprintf("Unsupported protocol version %d, supported: %v", req.Version, supportedVersions))
+	}
+
+	utils.Debug("Hello from %s, protocol %d, client '%s'", wsConn.Email, req.Version, req.Client)
+
+	payload, err := json.Marshal(HelloResponse{
+		Protocol:     req.Version,
+		Server:       config.Name(),
+		Version:      config.Version(),
+		Instance:     config.InstanceName(),
+		ConnectionId: wsConn.ConnectionId,
+		Codec:        wsConn.Codec,
+		MessageTypes: serverMessageTypes,
+		Modules:      getModulesInfo(),
+		Limits: HelloLimits{
+			MaxMessageSize: config.WS_MaxMessageSize(),
+			Heartbeat:      int64(config.WS_PingInterval().Seconds()),
+			PongTimeout:    int64(config.WS_PongTimeout().Seconds()),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	wsConn.Send(common.Message{Id: msg.Id, AppId: msg.AppId, Type: "hello", Payload: payload})
+
+	return nil
+}
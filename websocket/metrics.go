@@ -0,0 +1,37 @@
+package websocket
+
+import "sync/atomic"
+
+type Metrics struct {
+	MessagesSent  uint64 `json:"messagesSent"`
+	SlowConsumers uint64 `json:"slowConsumers"` // Connections closed because their send queue stayed full
+	Timeouts      uint64 `json:"timeouts"`      // Connections reaped because the peer stopped answering pings
+
+	OversizedMessages uint64 `json:"oversizedMessages"` // Connections closed with 1009
+
+	ThrottledMessages       uint64 `json:"throttledMessages"`
+	ThrottledDisconnections uint64 `json:"throttledDisconnections"` // Connections closed for repeatedly exceeding the rate limits
+
+	ForbiddenMessages uint64 `json:"forbiddenMessages"` // Denied for missing privileges or roles
+
+	ReplayedMessages uint64 `json:"replayedMessages"` // Pushes sent again to resumed connections
+}
+
+var metrics Metrics
+
+func GetMetrics() Metrics {
+	return Metrics{
+		MessagesSent:  atomic.LoadUint64(&metrics.MessagesSent),
+		SlowConsumers: atomic.LoadUint64(&metrics.SlowConsumers),
+		Timeouts:      atomic.LoadUint64(&metrics.Timeouts),
+
+		OversizedMessages: atomic.LoadUint64(&metrics.OversizedMessages),
+
+		ThrottledMessages:       atomic.LoadUint64(&metrics.ThrottledMessages),
+		ThrottledDisconnections: atomic.LoadUint64(&metrics.ThrottledDisconnections),
+
+		ForbiddenMessages: atomic.LoadUint64(&metrics.ForbiddenMessages),
+
+		ReplayedMessages: atomic.LoadUint64(&metrics.ReplayedMessages),
+	}
+}
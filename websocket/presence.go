@@ -0,0 +1,242 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"ekhoes-server/auth"
+	"ekhoes-server/common"
+	"ekhoes-server/config"
+	"ekhoes-server/db"
+	"ekhoes-server/module"
+	"ekhoes-server/utils"
+)
+
+// A user is online while at least one of its connections is alive, on any instance.
+// Changes are published on PresenceTopic(userId) and, for operators, on AllPresenceTopic.
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+
+	AllPresenceTopic = "presence"
+
+	// Last published state of a user, shared by the instances
+	presencePrefix = "presence"
+	presenceTTL    = 24 * time.Hour
+
+	maxPresenceQuery = 200
+)
+
+type Presence struct {
+	UserId string     `json:"userId"`
+	Status string     `json:"status"`
+	Since  *time.Time `json:"since,omitempty"` // Unknown when the last change is older than a day
+}
+
+var (
+	presencePending = make(map[string]*time.Timer) // User id -> debounce timer
+	presenceHooks   []func(Presence)
+	presenceMu      sync.Mutex
+)
+
+func canReadPresence(user auth.User) bool {
+	return auth.HasPrivilege(user.Privileges, "ek_read_websocket")
+}
+
+func PresenceTopic(userId string) string {
+	return fmt.Sprintf("%s:user:%s", presencePrefix, userId)
+}
+
+func presenceKey(userId string) string {
+	return fmt.Sprintf("%s:%s", presencePrefix, userId)
+}
+
+// A user can follow its own presence, the presence of anyone else is reserved to operators.
+// Topics of a module ("<appId>:...") are authorized by the module, see common.Module.CanSubscribe.
+func canSubscribe(user auth.User, topic string) bool {
+	if topic == AllPresenceTopic {
+		return canReadPresence(user)
+	}
+
+	if userId, ok := strings.CutPrefix(topic, PresenceTopic("")); ok {
+		return userId == user.Id || canReadPresence(user)
+	}
+
+	if appId, _, ok := strings.Cut(topic, ":"); ok {
+		if m, found := module.GetModule(appId); found && m.CanSubscribe != nil {
+			return m.CanSubscribe(user, topic)
+		}
+	}
+
+	return true
+}
+
+// OnPresence registers fn to be called on every published presence change
+func OnPresence(fn func(Presence)) {
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+
+	presenceHooks = append(presenceHooks, fn)
+}
+
+/**
+ * Called when a user connects or a session goes idle. The actual state is checked once the
+ * debounce delay has expired, so that a reconnecting client doesn't publish anything.
+ */
+func presenceChanged(userId string) {
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+
+	if _, pending := presencePending[userId]; pending {
+		return
+	}
+
+	presencePending[userId] = time.AfterFunc(config.WS_PresenceDebounce(), func() {
+		presenceMu.Lock()
+		delete(presencePending, userId)
+		presenceMu.Unlock()
+
+		checkPresence(userId)
+	})
+}
+
+func checkPresence(userId string) {
+	count, err := countUserConnections(userId)
+	if err != nil {
+		utils.Err(err)
+		return
+	}
+
+	status := PresenceOffline
+	if count > 0 || getUserConnectionsCount(userId) > 0 {
+		status = PresenceOnline
+	}
+
+	if last := getLastPresence(userId); last.Status == status {
+		return
+	}
+
+	now := time.Now().UTC()
+	presence := Presence{UserId: userId, Status: status, Since: &now}
+
+	data, err := json.Marshal(presence)
+	if err != nil {
+		utils.Err(err)
+		return
+	}
+
+	if err := db.SetWithTTL(presenceKey(userId), data, presenceTTL); err != nil {
+		utils.Err(err)
+	}
+
+	utils.Debug("User %s is %s", userId, status)
+
+	msg := common.Message{
+		Type:    "presence",
+		Payload: data,
+	}
+
+	Publish(PresenceTopic(userId), msg)
+	Publish(AllPresenceTopic, msg)
+
+	presenceMu.Lock()
+	hooks := presenceHooks
+	presenceMu.Unlock()
+
+	for _, fn := range hooks {
+		fn(presence)
+	}
+}
+
+// Last published state, offline if unknown
+func getLastPresence(userId string) Presence {
+	presence := Presence{UserId: userId, Status: PresenceOffline}
+
+	val, err := db.Get(presenceKey(userId))
+	if err != nil {
+		return presence
+	}
+
+	if err := json.Unmarshal([]byte(val), &presence); err != nil {
+		utils.Err(err)
+	}
+
+	return presence
+}
+
+/**
+ * GetPresence returns the current state of the given users: the last published one, corrected
+ * with the per user index of the registry. Users reconnecting stay online, the index keeps their
+ * closed connections for the resume grace period.
+ */
+func GetPresence(userIds []string) ([]Presence, error) {
+	result := make([]Presence, 0, len(userIds))
+
+	for _, userId := range userIds {
+		presence := getLastPresence(userId)
+
+		count, err := countUserConnections(userId)
+		if err != nil {
+			return nil, err
+		}
+
+		status := PresenceOffline
+		if count > 0 {
+			status = PresenceOnline
+		}
+
+		// Either still debouncing, or published by an instance that crashed or was drained
+		// before telling the user went offline. Without Redis this instance has the last word
+		// and publishes offline itself once the sessions go idle.
+		if presence.Status != status && (status == PresenceOnline || config.RedisEnabled()) {
+			presence.Status = status
+			presence.Since = nil
+		}
+
+		result = append(result, presence)
+	}
+
+	return result, nil
+}
+
+// Payload of presence queries
+type PresenceQuery struct {
+	UserIds []string `json:"userIds"`
+}
+
+/**
+ * Handle presence queries sent by clients
+ */
+func handlePresenceQuery(user auth.User, in common.Message, out *common.Message) error {
+	var query PresenceQuery
+
+	if err := json.Unmarshal(in.Payload, &query); err != nil {
+		return common.NewError(common.ErrBadRequest, err.Error())
+	}
+
+	if len(query.UserIds) > maxPresenceQuery {
+		return common.NewError(common.ErrBadRequest, fmt.Sprintf("at most %d users per query", maxPresenceQuery))
+	}
+
+	// Same rule as the presence topics
+	if !canReadPresence(user) {
+		for _, id := range query.UserIds {
+			if id != user.Id {
+				return common.NewError(common.ErrForbidden, "not allowed to read the presence of other users")
+			}
+		}
+	}
+
+	users, err := GetPresence(query.UserIds)
+	if err != nil {
+		return err
+	}
+
+	out.Type = "presence"
+	out.Payload, err = json.Marshal(map[string][]Presence{"users": users})
+
+	return err
+}
@@ -0,0 +1,47 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+
+	"ekhoes-server/auth"
+	"ekhoes-server/common"
+)
+
+func TestCanSubscribePresence(t *testing.T) {
+	user := auth.User{Id: "u1"}
+	operator := auth.User{Id: "op", Privileges: "ek_read_websocket"}
+
+	tests := []struct {
+		name  string
+		user  auth.User
+		topic string
+		want  bool
+	}{
+		{"own presence", user, PresenceTopic("u1"), true},
+		{"presence of another user", user, PresenceTopic("u2"), false},
+		{"every user", user, AllPresenceTopic, false},
+		{"operator, another user", operator, PresenceTopic("u2"), true},
+		{"operator, every user", operator, AllPresenceTopic, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canSubscribe(tt.user, tt.topic); got != tt.want {
+				t.Errorf("canSubscribe(%q) = %v, want %v", tt.topic, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPresenceQueryOfOtherUsers(t *testing.T) {
+	payload, _ := json.Marshal(PresenceQuery{UserIds: []string{"u1", "u2"}})
+
+	var reply common.Message
+
+	err := handlePresenceQuery(auth.User{Id: "u1"}, common.Message{Type: "presence", Payload: payload}, &reply)
+
+	if code := errorCode(err); code != common.ErrForbidden {
+		t.Errorf("error code = %q, want %q", code, common.ErrForbidden)
+	}
+}
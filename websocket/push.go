@@ -0,0 +1,190 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"ekhoes-server/auth"
+	"ekhoes-server/common"
+	"ekhoes-server/utils"
+)
+
+// Queue msg on every connection in list and return the number of recipients
+func sendTo(list []*WebsocketConnection, msg common.Message) int {
+	count := 0
+
+	for _, wsConn := range list {
+		if err := wsConn.Send(msg); err != nil {
+			utils.Error("Error sending message to connection %s: %s", wsConn.ConnectionId, err)
+			continue
+		}
+		count++
+	}
+
+	return count
+}
+
+// Number msg in the session buffers and queue it on every connection in list
+func deliverTo(list []*WebsocketConnection, msg common.Message) int {
+	bySession := make(map[string][]*WebsocketConnection)
+
+	for _, wsConn := range list {
+		bySession[wsConn.SessionId] = append(bySession[wsConn.SessionId], wsConn)
+	}
+
+	count := 0
+
+	for sessionId, conns := range bySession {
+		count += findSessionBuffer(sessionId).deliver(msg, func() []*WebsocketConnection {
+			return conns
+		})
+	}
+
+	return count
+}
+
+// Number msg in the buffers matching filter and queue it on all their connections.
+// Sessions reconnecting are included: they get the message on resume.
+func deliverToSessions(filter func(sessionId string, b *sessionBuffer) bool, msg common.Message) int {
+	count := 0
+
+	for sessionId, b := range findSessionBuffers(filter) {
+		count += b.deliver(msg, func() []*WebsocketConnection {
+			mu.RLock()
+			defer mu.RUnlock()
+
+			list := make([]*WebsocketConnection, 0, len(connections[sessionId]))
+			for _, wsConn := range connections[sessionId] {
+				list = append(list, wsConn)
+			}
+			return list
+		})
+	}
+
+	return count
+}
+
+// Recipients of a pushed message
+const (
+	targetConnection = "connection"
+	targetSession    = "session"
+	targetUser       = "user"
+	targetBroadcast  = "broadcast"
+	targetTopic      = "topic"
+)
+
+// Deliver msg to the matching connections of this instance
+func deliverLocal(kind string, target string, msg common.Message) int {
+	switch kind {
+	case targetConnection:
+		return deliverTo(findConnections(func(c *WebsocketConnection) bool {
+			return c.ConnectionId == target
+		}), msg)
+	case targetSession:
+		return deliverToSessions(func(sessionId string, b *sessionBuffer) bool {
+			return sessionId == target
+		}, msg)
+	case targetUser:
+		return deliverToSessions(func(sessionId string, b *sessionBuffer) bool {
+			return b.userId == target
+		}, msg)
+	case targetBroadcast:
+		return deliverToSessions(nil, msg)
+	case targetTopic:
+		return publishLocal(target, msg)
+	}
+
+	return 0
+}
+
+// Deliver msg locally and forward it to the other instances of the cluster
+func deliver(kind string, target string, msg common.Message) int {
+	count := deliverLocal(kind, target, msg)
+
+	publishOnBus(kind, target, msg)
+
+	return count
+}
+
+// The functions below return the number of recipients on this instance.
+// When the cluster bus is enabled the message reaches the other instances too.
+
+// SendToConnection pushes msg to a single connection. Returns false if the connection isn't on this instance.
+func SendToConnection(connectionId string, msg common.Message) bool {
+	if deliverLocal(targetConnection, connectionId, msg) > 0 {
+		return true
+	}
+
+	publishOnBus(targetConnection, connectionId, msg)
+
+	return false
+}
+
+// SendToSession pushes msg to every connection opened with the given session
+func SendToSession(sessionId string, msg common.Message) int {
+	return deliver(targetSession, sessionId, msg)
+}
+
+// SendToUser pushes msg to every connection of the given user, whatever the session
+func SendToUser(userId string, msg common.Message) int {
+	return deliver(targetUser, userId, msg)
+}
+
+// Broadcast pushes msg to every connected client
+func Broadcast(msg common.Message) int {
+	return deliver(targetBroadcast, "", msg)
+}
+
+/**
+ * POST /ws/message
+ * -d '{ "userId": "1000", "message": { "appId": "admin", "type": "notice", "payload": "Maintenance at 10pm" } }'
+ * Without connectionId, sessionId or userId the message is broadcast.
+ */
+func SendMessageHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := auth.CheckAuthorization(r, adminAudience)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if auth.HasPrivilege(claims.Privileges, "ek_write_websocket") == false {
+		http.Error(w, "missing required privileges", http.StatusUnauthorized)
+		return
+	}
+
+	type Payload struct {
+		ConnectionId string         `json:"connectionId"`
+		SessionId    string         `json:"sessionId"`
+		UserId       string         `json:"userId"`
+		Message      common.Message `json:"message"`
+	}
+
+	var payload Payload
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	recipients := 0
+
+	switch {
+	case payload.ConnectionId != "":
+		if SendToConnection(payload.ConnectionId, payload.Message) {
+			recipients = 1
+		}
+	case payload.SessionId != "":
+		recipients = SendToSession(payload.SessionId, payload.Message)
+	case payload.UserId != "":
+		recipients = SendToUser(payload.UserId, payload.Message)
+	default:
+		recipients = Broadcast(payload.Message)
+	}
+
+	utils.Log("Message of type '%s' sent to %d connections\n", payload.Message.Type, recipients)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int{"recipients": recipients})
+}
@@ -0,0 +1,181 @@
+package websocket
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ekhoes-server/common"
+	"ekhoes-server/config"
+	"ekhoes-server/module"
+	"ekhoes-server/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+const violationsWindow = time.Minute
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// A nil bucket (rate <= 0) allows everything
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// Limits shared by all the connections of a user
+type userLimiter struct {
+	bucket *tokenBucket
+	apps   map[string]*tokenBucket // Module limits, by app id
+}
+
+var (
+	userLimiters   = make(map[string]*userLimiter)
+	userLimitersMu sync.Mutex
+)
+
+// Per connection state
+type connLimiter struct {
+	bucket      *tokenBucket
+	violations  int
+	windowStart time.Time
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{
+		bucket: newTokenBucket(config.WS_RateConnection(), config.WS_BurstConnection()),
+	}
+}
+
+func getUserLimiter(userId string) *userLimiter {
+	userLimitersMu.Lock()
+	defer userLimitersMu.Unlock()
+
+	l, ok := userLimiters[userId]
+
+	if !ok {
+		l = &userLimiter{
+			bucket: newTokenBucket(config.WS_RateUser(), config.WS_BurstUser()),
+			apps:   make(map[string]*tokenBucket),
+		}
+		userLimiters[userId] = l
+	}
+
+	return l
+}
+
+func (l *userLimiter) appBucket(appId string) *tokenBucket {
+	userLimitersMu.Lock()
+	defer userLimitersMu.Unlock()
+
+	if b, ok := l.apps[appId]; ok {
+		return b
+	}
+
+	// Only modules declaring a limit get a bucket: the appId comes from the client
+	m, found := module.GetModule(appId)
+	if !found || m.RateLimit == nil {
+		return nil
+	}
+
+	b := newTokenBucket(m.RateLimit.Rate, m.RateLimit.Burst)
+	l.apps[appId] = b
+
+	return b
+}
+
+// Called when the last connection of a user is gone
+func removeUserLimiter(userId string) {
+	userLimitersMu.Lock()
+	defer userLimitersMu.Unlock()
+
+	delete(userLimiters, userId)
+}
+
+/**
+ * Check the connection, user and module limits. A throttled message returns an error
+ * to be sent back to the client; too many of them in a minute close the connection.
+ * Server message types are handled by the server whatever their appId, which doesn't
+ * pick a module limit for them.
+ */
+func checkRateLimit(wsConn *WebsocketConnection, msg common.Message) error {
+	user := getUserLimiter(wsConn.UserId)
+
+	var app *tokenBucket
+	if !slices.Contains(serverMessageTypes, msg.Type) {
+		app = user.appBucket(msg.AppId)
+	}
+
+	if wsConn.limiter.bucket.allow() && user.bucket.allow() && app.allow() {
+		return nil
+	}
+
+	return throttled(wsConn)
+}
+
+// Count a violation of the limits of wsConn and return the error for the client
+func throttled(wsConn *WebsocketConnection) error {
+	atomic.AddUint64(&metrics.ThrottledMessages, 1)
+
+	l := wsConn.limiter
+	now := time.Now()
+
+	if now.Sub(l.windowStart) > violationsWindow {
+		l.windowStart = now
+		l.violations = 0
+	}
+
+	l.violations++
+
+	if l.violations >= config.WS_MaxViolations() {
+		atomic.AddUint64(&metrics.ThrottledDisconnections, 1)
+		utils.Error("Rate limit repeatedly exceeded by %s, closing connection %s", wsConn.Email, wsConn.ConnectionId)
+		wsConn.Close(websocket.ClosePolicyViolation /* 1008 */, "Rate limit exceeded")
+	}
+
+	return common.NewError(common.ErrThrottled, "rate limit exceeded")
+}
@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"ekhoes-server/common"
+	"ekhoes-server/module"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 3)
+
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatalf("message %d of the burst refused", i)
+		}
+	}
+
+	if b.allow() {
+		t.Fatal("message allowed past the burst")
+	}
+
+	// 10 per second: one token every 100ms
+	time.Sleep(150 * time.Millisecond)
+
+	if !b.allow() {
+		t.Error("token not refilled")
+	}
+
+	if b.allow() {
+		t.Error("more tokens than the elapsed time gives")
+	}
+
+	// Never more than the burst
+	b = newTokenBucket(1000, 2)
+	time.Sleep(20 * time.Millisecond)
+
+	if !b.allow() || !b.allow() || b.allow() {
+		t.Error("bucket filled past its burst")
+	}
+
+	if b := newTokenBucket(1, 0); !b.allow() || b.allow() {
+		t.Error("a burst below 1 must allow a single message")
+	}
+
+	unlimited := newTokenBucket(0, 5)
+
+	for i := 0; i < 100; i++ {
+		if !unlimited.allow() {
+			t.Fatal("rate 0 must not limit")
+		}
+	}
+}
+
+func limitedConnection(t *testing.T, sessionId, userId string) *WebsocketConnection {
+	t.Cleanup(func() { removeUserLimiter(userId) })
+
+	wsConn := testConnection(sessionId, userId, 1)
+	wsConn.ConnectionId = sessionId
+
+	return wsConn
+}
+
+func TestRateLimitPerConnectionAndUser(t *testing.T) {
+	t.Setenv("EKHOES_WS_RATE_CONNECTION", "0.001")
+	t.Setenv("EKHOES_WS_BURST_CONNECTION", "2")
+	t.Setenv("EKHOES_WS_RATE_USER", "0.001")
+	t.Setenv("EKHOES_WS_BURST_USER", "3")
+	t.Setenv("EKHOES_WS_MAX_VIOLATIONS", "100")
+
+	first := limitedConnection(t, "s1", "u1")
+	second := limitedConnection(t, "s2", "u1")
+	other := limitedConnection(t, "s3", "u2")
+
+	msg := common.Message{AppId: "test", Type: "query"}
+
+	steps := []struct {
+		name    string
+		wsConn  *WebsocketConnection
+		allowed bool
+	}{
+		{"first connection", first, true},
+		{"first connection, burst", first, true},
+		{"first connection over its limit", first, false},
+		{"same user, other connection", second, true},
+		{"same user over its limit", second, false},
+		{"other user", other, true},
+	}
+
+	for _, s := range steps {
+		err := checkRateLimit(s.wsConn, msg)
+
+		if s.allowed && err != nil {
+			t.Errorf("%s: %v", s.name, err)
+		} else if !s.allowed && errorCode(err) != common.ErrThrottled {
+			t.Errorf("%s: error %v, want %s", s.name, err, common.ErrThrottled)
+		}
+	}
+}
+
+func TestRateLimitPerModule(t *testing.T) {
+	t.Setenv("EKHOES_WS_RATE_CONNECTION", "")
+	t.Setenv("EKHOES_WS_RATE_USER", "")
+	t.Setenv("EKHOES_WS_MAX_VIOLATIONS", "100")
+
+	module.Register(common.Module{Id: "ratetest", RateLimit: &common.RateLimit{Rate: 0.001, Burst: 1}})
+
+	wsConn := limitedConnection(t, "s1", "u1")
+
+	if err := checkRateLimit(wsConn, common.Message{AppId: "ratetest", Type: "query"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkRateLimit(wsConn, common.Message{AppId: "ratetest", Type: "query"}); errorCode(err) != common.ErrThrottled {
+		t.Errorf("over the module limit: error %v, want %s", err, common.ErrThrottled)
+	}
+
+	// The limit of a module doesn't apply to the others, nor to the server message types
+	for _, msg := range []common.Message{{AppId: "other", Type: "query"}, {AppId: "ratetest", Type: "ping"}} {
+		if err := checkRateLimit(wsConn, msg); err != nil {
+			t.Errorf("%s/%s: %v", msg.AppId, msg.Type, err)
+		}
+	}
+}
+
+func TestRateLimitViolationsClose(t *testing.T) {
+	t.Setenv("EKHOES_WS_RATE_CONNECTION", "0.001")
+	t.Setenv("EKHOES_WS_BURST_CONNECTION", "1")
+	t.Setenv("EKHOES_WS_RATE_USER", "")
+	t.Setenv("EKHOES_WS_MAX_VIOLATIONS", "3")
+
+	wsConn := limitedConnection(t, "s1", "u1")
+	msg := common.Message{AppId: "test", Type: "query"}
+
+	checkRateLimit(wsConn, msg)
+
+	for i := 1; i <= 3; i++ {
+		if isClosing(wsConn) {
+			t.Fatalf("closed after %d violations", i-1)
+		}
+
+		checkRateLimit(wsConn, msg)
+	}
+
+	if !isClosing(wsConn) || wsConn.closeCode != websocket.ClosePolicyViolation {
+		t.Errorf("closing %v with code %d, want 1008", isClosing(wsConn), wsConn.closeCode)
+	}
+}
@@ -0,0 +1,294 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"ekhoes-server/config"
+	"ekhoes-server/db"
+	"ekhoes-server/utils"
+)
+
+// With Redis, every instance registers its connections under ws:conn:<node>:<connectionId>.
+// Entries are refreshed by a heartbeat and expire by themselves when their instance dies.
+// Without Redis there's a single instance and the registry is the local connections map.
+const registryPrefix = "ws:conn"
+
+// Hash of the connection count of every node (ws:nodes -> <node> -> nodeEntry), written at every
+// connect, disconnect and heartbeat, so counting doesn't need to walk the registry.
+// Fields of dead instances are dropped by the readers once expired.
+const nodesKey = "ws:nodes"
+
+// Per user index of the registry (ws:user:<userId> -> <node>:<connectionId> -> expiry), so that
+// presence is known without walking the registry. A closed connection stays in the index for
+// WS_ResumeGrace(), as long as its session is considered online.
+const userIndexPrefix = "ws:user"
+
+func userIndexKey(userId string) string {
+	return fmt.Sprintf("%s:%s", userIndexPrefix, userId)
+}
+
+type nodeEntry struct {
+	Connections int   `json:"connections"`
+	Expires     int64 `json:"expires"` // Unix time
+}
+
+type ConnectionEntry struct {
+	ConnectionId string    `json:"connectionId"`
+	SessionId    string    `json:"sessionId"`
+	UserId       string    `json:"userId"`
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	Node         string    `json:"node"`
+	Codec        string    `json:"codec"`
+	Created      time.Time `json:"created"`
+}
+
+var registryQuit chan struct{}
+
+func registryKey(node string, connectionId string) string {
+	return fmt.Sprintf("%s:%s:%s", registryPrefix, node, connectionId)
+}
+
+func newConnectionEntry(wsConn *WebsocketConnection) ConnectionEntry {
+	return ConnectionEntry{
+		ConnectionId: wsConn.ConnectionId,
+		SessionId:    wsConn.SessionId,
+		UserId:       wsConn.UserId,
+		Name:         wsConn.Name,
+		Email:        wsConn.Email,
+		Node:         config.InstanceName(),
+		Codec:        wsConn.Codec,
+		Created:      wsConn.Created,
+	}
+}
+
+func registerConnection(wsConn *WebsocketConnection) {
+	if !config.RedisEnabled() {
+		return
+	}
+
+	writeConnectionEntry(wsConn)
+	registerNode()
+}
+
+func writeConnectionEntry(wsConn *WebsocketConnection) {
+	entry := newConnectionEntry(wsConn)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		utils.Err(err)
+		return
+	}
+
+	if err := db.SetWithTTL(registryKey(entry.Node, entry.ConnectionId), data, config.WS_RegistryTTL()); err != nil {
+		utils.Error("Error registering connection %s: %s", entry.ConnectionId, err)
+	}
+
+	indexConnection(wsConn, config.WS_RegistryTTL())
+}
+
+// Set the expiry of the connection in the index of its user
+func indexConnection(wsConn *WebsocketConnection, ttl time.Duration) {
+	key := userIndexKey(wsConn.UserId)
+
+	if err := db.HashSet(key, registryKey(config.InstanceName(), wsConn.ConnectionId), time.Now().Add(ttl).Unix()); err != nil {
+		utils.Error("Error indexing connection %s: %s", wsConn.ConnectionId, err)
+		return
+	}
+
+	if err := db.UpdateTTL(key, config.WS_RegistryTTL()+config.WS_ResumeGrace()); err != nil {
+		utils.Err(err)
+	}
+}
+
+func unregisterConnection(wsConn *WebsocketConnection) {
+	if !config.RedisEnabled() {
+		return
+	}
+
+	if _, err := db.DeleteKey(registryKey(config.InstanceName(), wsConn.ConnectionId)); err != nil {
+		utils.Error("Error unregistering connection %s: %s", wsConn.ConnectionId, err)
+	}
+
+	indexConnection(wsConn, config.WS_ResumeGrace())
+	registerNode()
+}
+
+// Publish the connection count of this instance
+func registerNode() {
+	data, err := json.Marshal(nodeEntry{
+		Connections: int(GetConnectionsCount()),
+		Expires:     time.Now().Add(config.WS_RegistryTTL()).Unix(),
+	})
+	if err != nil {
+		utils.Err(err)
+		return
+	}
+
+	if err := db.HashSet(nodesKey, config.InstanceName(), data); err != nil {
+		utils.Error("Error registering node: %s", err)
+	}
+}
+
+/**
+ * Refresh the registry entries of this instance
+ */
+func StartRegistry() {
+	if !config.RedisEnabled() {
+		return
+	}
+
+	registryQuit = make(chan struct{})
+
+	ticker := time.NewTicker(config.WS_RegistryTTL() / 3)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				for _, wsConn := range findConnections(nil) {
+					writeConnectionEntry(wsConn)
+				}
+				registerNode()
+			case <-registryQuit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func StopRegistry() {
+	if registryQuit == nil {
+		return
+	}
+
+	close(registryQuit)
+
+	for _, wsConn := range findConnections(nil) {
+		if _, err := db.DeleteKey(registryKey(config.InstanceName(), wsConn.ConnectionId)); err != nil {
+			utils.Error("Error unregistering connection %s: %s", wsConn.ConnectionId, err)
+		}
+
+		indexConnection(wsConn, config.WS_ResumeGrace())
+	}
+
+	if err := db.HashDelete(nodesKey, config.InstanceName()); err != nil {
+		utils.Error("Error unregistering node: %s", err)
+	}
+}
+
+/**
+ * Return the connections of the whole cluster, or of a single node if node isn't empty
+ */
+func GetClusterConnections(node string) ([]ConnectionEntry, error) {
+	if !config.RedisEnabled() {
+		var result []ConnectionEntry
+
+		if node == "" || node == config.InstanceName() {
+			for _, wsConn := range findConnections(nil) {
+				result = append(result, newConnectionEntry(wsConn))
+			}
+		}
+
+		return result, nil
+	}
+
+	pattern := registryPrefix + ":*"
+	if node != "" {
+		pattern = fmt.Sprintf("%s:%s:*", registryPrefix, node)
+	}
+
+	keys, err := db.GetKeysByPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ConnectionEntry, 0, len(keys))
+
+	for _, key := range keys {
+		val, err := db.Get(key)
+		if err != nil {
+			// Expired in the meantime
+			continue
+		}
+
+		var entry ConnectionEntry
+		if err := json.Unmarshal([]byte(val), &entry); err != nil {
+			log.Printf("Invalid registry entry %s: %v", key, err)
+			continue
+		}
+
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+// Number of connections per node, read from the nodes hash: a single command whatever the cluster size
+func GetClusterNodes() (map[string]int, error) {
+	if !config.RedisEnabled() {
+		return map[string]int{config.InstanceName(): int(GetConnectionsCount())}, nil
+	}
+
+	fields, err := db.HashGetAll(nodesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	nodes := make(map[string]int, len(fields))
+
+	for node, val := range fields {
+		var entry nodeEntry
+		if err := json.Unmarshal([]byte(val), &entry); err != nil || entry.Expires < now {
+			// Dead instance
+			db.HashDelete(nodesKey, node)
+			continue
+		}
+
+		nodes[node] = entry.Connections
+	}
+
+	return nodes, nil
+}
+
+/**
+ * Number of connections of a user on the whole cluster, counting those closed less than
+ * WS_ResumeGrace() ago. Entries of dead instances expire with the heartbeat.
+ */
+func countUserConnections(userId string) (int, error) {
+	if !config.RedisEnabled() {
+		return getUserConnectionsCount(userId), nil
+	}
+
+	key := userIndexKey(userId)
+
+	fields, err := db.HashGetAll(key)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+	count := 0
+
+	var expired []string
+
+	for field, val := range fields {
+		if expires, err := strconv.ParseInt(val, 10, 64); err == nil && expires > now {
+			count++
+		} else {
+			expired = append(expired, field)
+		}
+	}
+
+	if len(expired) > 0 {
+		db.HashDelete(key, expired...)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,275 @@
+package websocket
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ekhoes-server/auth"
+	"ekhoes-server/common"
+	"ekhoes-server/config"
+	"ekhoes-server/utils"
+)
+
+// Every session connected to this instance has a buffer numbering the pushes it receives.
+// Numbers only make sense within their buffer, identified by an epoch sent along with them.
+// A client reconnecting with ?resume=<epoch>:<lastSeq> gets the pushes it missed, as long as
+// they are still in the buffer (see WS_ReplaySize() and WS_ReplayMaxAge()). A token of another
+// buffer (another instance, or a buffer already dropped) replays nothing and isn't complete.
+//
+// Replies and errors are bound to the request and its connection: they have no sequence number
+// and are never replayed. Topic subscriptions belong to the connection and must be renewed.
+
+type replayEntry struct {
+	msg common.Message
+	at  time.Time
+}
+
+type sessionBuffer struct {
+	mu      sync.Mutex // Held while a push is numbered and queued, so that a resume can't miss it
+	epoch   string
+	userId  string
+	seq     uint64
+	entries []replayEntry
+
+	// Guarded by buffersMu
+	refs        int // Connections of the session on this instance
+	idleTimer   *time.Timer
+	expireTimer *time.Timer
+}
+
+// Session id -> buffer
+var (
+	buffers   = make(map[string]*sessionBuffer)
+	buffersMu sync.Mutex
+)
+
+// The payload of the message sent to a resumed connection
+type ResumeResult struct {
+	Epoch    string `json:"epoch"`    // Buffer numbering the pushes from now on
+	Seq      uint64 `json:"seq"`      // Last sequence number of the session
+	Replayed int    `json:"replayed"` // Messages sent again
+	Complete bool   `json:"complete"` // False if some missed messages are gone, the client should reload its state
+}
+
+// Called for every new connection, before it's added to the registry
+func acquireSessionBuffer(sessionId, userId string) *sessionBuffer {
+	buffersMu.Lock()
+	defer buffersMu.Unlock()
+
+	b, ok := buffers[sessionId]
+
+	if !ok {
+		b = &sessionBuffer{epoch: utils.ULID(), userId: userId}
+		buffers[sessionId] = b
+	}
+
+	// The session is back before going idle
+	if b.idleTimer != nil {
+		b.idleTimer.Stop()
+		b.idleTimer = nil
+	}
+
+	if b.expireTimer != nil {
+		b.expireTimer.Stop()
+		b.expireTimer = nil
+	}
+
+	b.refs++
+
+	return b
+}
+
+/**
+ * Called when a connection is gone. When it's the last one of the session, the session is
+ * flagged idle after WS_ResumeGrace() and the buffer is dropped after WS_ReplayMaxAge(),
+ * unless the client reconnects in the meantime.
+ */
+func releaseSessionBuffer(sessionId string) {
+	buffersMu.Lock()
+	defer buffersMu.Unlock()
+
+	b, ok := buffers[sessionId]
+
+	if !ok {
+		return
+	}
+
+	b.refs--
+
+	if b.refs > 0 {
+		return
+	}
+
+	b.idleTimer = time.AfterFunc(config.WS_ResumeGrace(), func() {
+		buffersMu.Lock()
+		idle := b.refs == 0
+		buffersMu.Unlock()
+
+		if idle {
+			auth.SetSessionActive(sessionId, false)
+			presenceChanged(b.userId)
+		}
+	})
+
+	b.expireTimer = time.AfterFunc(config.WS_ReplayMaxAge(), func() {
+		buffersMu.Lock()
+		defer buffersMu.Unlock()
+
+		if b.refs == 0 && buffers[sessionId] == b {
+			delete(buffers, sessionId)
+		}
+	})
+}
+
+func findSessionBuffer(sessionId string) *sessionBuffer {
+	buffersMu.Lock()
+	defer buffersMu.Unlock()
+
+	return buffers[sessionId]
+}
+
+// Return the sessions whose buffer matches filter, all of them if filter is nil
+func findSessionBuffers(filter func(sessionId string, b *sessionBuffer) bool) map[string]*sessionBuffer {
+	buffersMu.Lock()
+	defer buffersMu.Unlock()
+
+	result := make(map[string]*sessionBuffer)
+
+	for sessionId, b := range buffers {
+		if filter == nil || filter(sessionId, b) {
+			result[sessionId] = b
+		}
+	}
+
+	return result
+}
+
+// Drop the entries exceeding count and age. Must be called with b.mu held.
+func (b *sessionBuffer) prune(now time.Time) {
+	maxAge := config.WS_ReplayMaxAge()
+	size := config.WS_ReplaySize()
+
+	i := 0
+	for i < len(b.entries) && (len(b.entries)-i > size || now.Sub(b.entries[i].at) > maxAge) {
+		i++
+	}
+
+	if i > 0 {
+		b.entries = append(b.entries[:0], b.entries[i:]...)
+	}
+}
+
+/**
+ * Number msg, keep it for replay and queue it on recipients, all while holding the buffer lock.
+ * recipients is evaluated under the lock, so that a connection being resumed either gets
+ * the message from the replay or directly. A nil buffer just sends the message.
+ */
+func (b *sessionBuffer) deliver(msg common.Message, recipients func() []*WebsocketConnection) int {
+	if b == nil {
+		return sendTo(recipients(), msg)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if config.WS_ReplaySize() > 0 {
+		now := time.Now()
+
+		b.seq++
+		msg.Seq = b.seq
+		msg.Epoch = b.epoch
+
+		b.entries = append(b.entries, replayEntry{msg: msg, at: now})
+		b.prune(now)
+	}
+
+	return sendTo(recipients(), msg)
+}
+
+/**
+ * Queue on wsConn the pushes numbered after lastSeq. Must be called with b.mu held.
+ */
+func (b *sessionBuffer) replay(wsConn *WebsocketConnection, lastSeq uint64) ResumeResult {
+	b.prune(time.Now())
+
+	result := ResumeResult{
+		Epoch:    b.epoch,
+		Seq:      b.seq,
+		Complete: lastSeq <= b.seq,
+	}
+
+	// Something between lastSeq and the oldest entry was dropped
+	if len(b.entries) > 0 && b.entries[0].msg.Seq > lastSeq+1 {
+		result.Complete = false
+	} else if len(b.entries) == 0 && lastSeq < b.seq {
+		result.Complete = false
+	}
+
+	for _, entry := range b.entries {
+		if entry.msg.Seq <= lastSeq && result.Complete {
+			continue
+		}
+
+		if err := wsConn.Send(entry.msg); err != nil {
+			break
+		}
+
+		result.Replayed++
+	}
+
+	atomic.AddUint64(&metrics.ReplayedMessages, uint64(result.Replayed))
+
+	return result
+}
+
+/**
+ * Add a new connection to the registry and start its writer. When the client asks to resume
+ * (?resume=<epoch>:<lastSeq>), the pushes it missed are queued before any new one, followed by a
+ * "resumed" message.
+ */
+func connect(wsConn *WebsocketConnection, resume string) error {
+	b := acquireSessionBuffer(wsConn.SessionId, wsConn.UserId)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := AddConnection(wsConn); err != nil {
+		releaseSessionBuffer(wsConn.SessionId)
+		return err
+	}
+
+	go wsConn.writePump()
+
+	presenceChanged(wsConn.UserId)
+
+	if resume == "" {
+		return nil
+	}
+
+	var result ResumeResult
+
+	epoch, seq, _ := strings.Cut(resume, ":")
+	lastSeq, err := strconv.ParseUint(seq, 10, 64)
+
+	if err != nil {
+		utils.Error("Invalid resume token from %s: %s", wsConn.Email, resume)
+	}
+
+	if err == nil && epoch == b.epoch {
+		result = b.replay(wsConn, lastSeq)
+	} else {
+		// Numbered by another buffer: nothing can be told about what was missed
+		result = ResumeResult{Epoch: b.epoch, Seq: b.seq, Complete: false}
+	}
+
+	utils.Log("Connection %s of %s resumed from %d, %d messages replayed\n", wsConn.ConnectionId, wsConn.Email, lastSeq, result.Replayed)
+
+	payload, _ := json.Marshal(result)
+	wsConn.Send(common.Message{Type: "resumed", Payload: payload})
+
+	return nil
+}
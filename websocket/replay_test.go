@@ -0,0 +1,108 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"ekhoes-server/common"
+)
+
+func noRecipients() []*WebsocketConnection {
+	return nil
+}
+
+// The sequence numbers queued on wsConn
+func queuedSeqs(wsConn *WebsocketConnection) []uint64 {
+	var seqs []uint64
+
+	for len(wsConn.send) > 0 {
+		seqs = append(seqs, (<-wsConn.send).Seq)
+	}
+
+	return seqs
+}
+
+func TestReplay(t *testing.T) {
+	t.Setenv("EKHOES_WS_REPLAY_SIZE", "3")
+	t.Setenv("EKHOES_WS_REPLAY_MAX_AGE", "120")
+
+	b := &sessionBuffer{epoch: "e1"}
+
+	for i := 0; i < 5; i++ {
+		b.deliver(common.Message{Type: "push"}, noRecipients)
+	}
+
+	// Entries 3 to 5 are left
+	tests := []struct {
+		name     string
+		lastSeq  uint64
+		replayed []uint64
+		complete bool
+	}{
+		{"up to date", 5, nil, true},
+		{"missed the last ones", 3, []uint64{4, 5}, true},
+		{"missed exactly what's left", 2, []uint64{3, 4, 5}, true},
+		{"missed more than what's left", 1, []uint64{3, 4, 5}, false},
+		{"ahead of the buffer", 7, []uint64{3, 4, 5}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wsConn := testConnection("s1", "u1", 10)
+
+			result := b.replay(wsConn, tt.lastSeq)
+			seqs := queuedSeqs(wsConn)
+
+			if result.Epoch != "e1" || result.Seq != 5 || result.Complete != tt.complete || result.Replayed != len(tt.replayed) {
+				t.Errorf("result %+v, want epoch e1, seq 5, complete %v, %d replayed", result, tt.complete, len(tt.replayed))
+			}
+
+			if len(seqs) != len(tt.replayed) {
+				t.Fatalf("replayed %v, want %v", seqs, tt.replayed)
+			}
+
+			for i := range seqs {
+				if seqs[i] != tt.replayed[i] {
+					t.Fatalf("replayed %v, want %v", seqs, tt.replayed)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayMaxAge(t *testing.T) {
+	t.Setenv("EKHOES_WS_REPLAY_SIZE", "100")
+	t.Setenv("EKHOES_WS_REPLAY_MAX_AGE", "60")
+
+	b := &sessionBuffer{epoch: "e1"}
+
+	for i := 0; i < 3; i++ {
+		b.deliver(common.Message{Type: "push"}, noRecipients)
+	}
+
+	b.entries[0].at = time.Now().Add(-2 * time.Minute)
+
+	wsConn := testConnection("s1", "u1", 10)
+	result := b.replay(wsConn, 0)
+
+	if result.Complete || result.Replayed != 2 {
+		t.Errorf("result %+v, want 2 replayed and incomplete", result)
+	}
+}
+
+func TestDeliverWithoutReplay(t *testing.T) {
+	t.Setenv("EKHOES_WS_REPLAY_SIZE", "0")
+
+	b := &sessionBuffer{epoch: "e1"}
+	wsConn := testConnection("s1", "u1", 1)
+
+	n := b.deliver(common.Message{Type: "push"}, func() []*WebsocketConnection { return []*WebsocketConnection{wsConn} })
+
+	if n != 1 || len(b.entries) != 0 {
+		t.Errorf("%d recipients, %d entries kept: want 1, 0", n, len(b.entries))
+	}
+
+	if msg := <-wsConn.send; msg.Seq != 0 || msg.Epoch != "" {
+		t.Errorf("message numbered %s:%d without a buffer", msg.Epoch, msg.Seq)
+	}
+}
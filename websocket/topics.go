@@ -0,0 +1,204 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"ekhoes-server/auth"
+	"ekhoes-server/common"
+	"ekhoes-server/config"
+	"ekhoes-server/utils"
+)
+
+const maxTopicLength = 200
+
+// Topic -> connection id -> connection
+var (
+	subscribers = make(map[string]map[string]*WebsocketConnection)
+	topicsMu    sync.RWMutex
+)
+
+var InvalidTopic = errors.New("invalid topic")
+
+// Payload of subscribe/unsubscribe messages. Both a single topic and a list are accepted.
+type TopicRequest struct {
+	Topic  string   `json:"topic,omitempty"`
+	Topics []string `json:"topics,omitempty"`
+}
+
+func (t TopicRequest) list() []string {
+	list := t.Topics
+
+	if t.Topic != "" {
+		list = append(list, t.Topic)
+	}
+
+	return list
+}
+
+func validTopic(topic string) bool {
+	return topic != "" && len(topic) <= maxTopicLength && !strings.ContainsAny(topic, " \t\r\n")
+}
+
+func Subscribe(wsConn *WebsocketConnection, topic string) error {
+	if !validTopic(topic) {
+		return InvalidTopic
+	}
+
+	topicsMu.Lock()
+	defer topicsMu.Unlock()
+
+	if _, ok := subscribers[topic]; !ok {
+		subscribers[topic] = make(map[string]*WebsocketConnection)
+	}
+
+	subscribers[topic][wsConn.ConnectionId] = wsConn
+
+	if wsConn.topics == nil {
+		wsConn.topics = make(map[string]struct{})
+	}
+
+	wsConn.topics[topic] = struct{}{}
+
+	return nil
+}
+
+func Unsubscribe(wsConn *WebsocketConnection, topic string) {
+	topicsMu.Lock()
+	defer topicsMu.Unlock()
+
+	removeSubscription(wsConn, topic)
+}
+
+// Must be called with topicsMu held
+func removeSubscription(wsConn *WebsocketConnection, topic string) {
+	if connMap, ok := subscribers[topic]; ok {
+		delete(connMap, wsConn.ConnectionId)
+
+		if len(connMap) == 0 {
+			delete(subscribers, topic)
+		}
+	}
+
+	delete(wsConn.topics, topic)
+}
+
+func unsubscribeAll(wsConn *WebsocketConnection) {
+	topicsMu.Lock()
+	defer topicsMu.Unlock()
+
+	for topic := range wsConn.topics {
+		removeSubscription(wsConn, topic)
+	}
+}
+
+// GetTopics returns the topics with at least one subscriber and their subscriber count
+func GetTopics() map[string]int {
+	topicsMu.RLock()
+	defer topicsMu.RUnlock()
+
+	result := make(map[string]int, len(subscribers))
+
+	for topic, connMap := range subscribers {
+		result[topic] = len(connMap)
+	}
+
+	return result
+}
+
+// Publish sends msg to every connection subscribed to topic, on every instance of the cluster.
+// Returns the number of recipients on this instance.
+func Publish(topic string, msg common.Message) int {
+	return deliver(targetTopic, topic, msg)
+}
+
+func publishLocal(topic string, msg common.Message) int {
+	msg.Topic = topic
+
+	topicsMu.RLock()
+	recipients := make([]*WebsocketConnection, 0, len(subscribers[topic]))
+	for _, wsConn := range subscribers[topic] {
+		recipients = append(recipients, wsConn)
+	}
+	topicsMu.RUnlock()
+
+	return deliverTo(recipients, msg)
+}
+
+/**
+ * Enforce WS_MaxSubscriptions() on wsConn and charge the topics to its rate limit:
+ * the message itself already took a token, each other topic takes one more
+ */
+func checkSubscriptions(wsConn *WebsocketConnection, topics []string) error {
+	topicsMu.RLock()
+	count := len(wsConn.topics)
+	for _, topic := range topics {
+		if _, ok := wsConn.topics[topic]; !ok {
+			count++
+		}
+	}
+	topicsMu.RUnlock()
+
+	if max := config.WS_MaxSubscriptions(); count > max {
+		return common.NewError(common.ErrBadRequest, fmt.Sprintf("too many subscriptions, at most %d per connection", max))
+	}
+
+	for range topics[1:] {
+		if !wsConn.limiter.bucket.allow() {
+			return throttled(wsConn)
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Handle subscribe/unsubscribe messages sent by clients
+ */
+func handleTopicMessage(wsConn *WebsocketConnection, user auth.User, in common.Message, out *common.Message) error {
+	var req TopicRequest
+
+	if err := json.Unmarshal(in.Payload, &req); err != nil {
+		return common.NewError(common.ErrBadRequest, "invalid payload for '"+in.Type+"'")
+	}
+
+	topics := req.list()
+
+	if len(topics) == 0 {
+		return common.NewError(common.ErrBadRequest, InvalidTopic.Error())
+	}
+
+	if max := config.WS_MaxTopicsPerMessage(); len(topics) > max {
+		return common.NewError(common.ErrBadRequest, fmt.Sprintf("too many topics, at most %d per message", max))
+	}
+
+	// Checked before any authorization: CanSubscribe can cost a query per topic
+	if in.Type == "subscribe" {
+		if err := checkSubscriptions(wsConn, topics); err != nil {
+			return err
+		}
+	}
+
+	for _, topic := range topics {
+		if in.Type == "subscribe" {
+			if !canSubscribe(user, topic) {
+				return common.NewError(common.ErrForbidden, "not allowed to subscribe to "+topic)
+			}
+			if err := Subscribe(wsConn, topic); err != nil {
+				return common.NewError(common.ErrBadRequest, err.Error()+": "+topic)
+			}
+			utils.Debug("Connection %s subscribed to %s", wsConn.ConnectionId, topic)
+		} else {
+			Unsubscribe(wsConn, topic)
+			utils.Debug("Connection %s unsubscribed from %s", wsConn.ConnectionId, topic)
+		}
+	}
+
+	out.Type = in.Type + "d" // subscribed, unsubscribed
+	out.Payload, _ = json.Marshal(TopicRequest{Topics: topics})
+
+	return nil
+}
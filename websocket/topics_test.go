@@ -0,0 +1,99 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"ekhoes-server/auth"
+	"ekhoes-server/common"
+)
+
+func subscribeMessage(topics ...string) common.Message {
+	payload, _ := json.Marshal(TopicRequest{Topics: topics})
+
+	return common.Message{AppId: "test", Type: "subscribe", Payload: payload}
+}
+
+func topicList(prefix string, n int) []string {
+	list := make([]string, n)
+
+	for i := range list {
+		list[i] = fmt.Sprintf("%s:%d", prefix, i)
+	}
+
+	return list
+}
+
+func errorCode(err error) string {
+	var e *common.Error
+
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	return ""
+}
+
+func TestSubscribeLimits(t *testing.T) {
+	t.Setenv("EKHOES_WS_MAX_TOPICS_PER_MESSAGE", "5")
+	t.Setenv("EKHOES_WS_MAX_SUBSCRIPTIONS", "8")
+	t.Setenv("EKHOES_WS_RATE_CONNECTION", "1")
+	t.Setenv("EKHOES_WS_BURST_CONNECTION", "100")
+
+	wsConn := testConnection("s1", "u1", 1)
+	wsConn.ConnectionId = "c1"
+	t.Cleanup(func() { unsubscribeAll(wsConn) })
+
+	user := auth.User{Id: "u1"}
+
+	tests := []struct {
+		name   string
+		topics []string
+		code   string // Error code, "" for success
+		count  int    // Subscriptions of the connection afterwards
+	}{
+		{"within the limits", topicList("test:a", 5), "", 5},
+		{"too many topics in a message", topicList("test:b", 6), common.ErrBadRequest, 5},
+		{"too many subscriptions", topicList("test:c", 4), common.ErrBadRequest, 5},
+		{"already subscribed topics don't count", append(topicList("test:a", 2), topicList("test:d", 3)...), "", 8},
+	}
+
+	for _, tt := range tests {
+		var out common.Message
+
+		err := handleTopicMessage(wsConn, user, subscribeMessage(tt.topics...), &out)
+
+		if code := errorCode(err); code != tt.code || (tt.code == "" && err != nil) {
+			t.Errorf("%s: error = %v, want code %q", tt.name, err, tt.code)
+		}
+
+		if n := len(wsConn.topics); n != tt.count {
+			t.Errorf("%s: subscriptions = %d, want %d", tt.name, n, tt.count)
+		}
+	}
+}
+
+func TestSubscribeChargesTheConnection(t *testing.T) {
+	t.Setenv("EKHOES_WS_MAX_TOPICS_PER_MESSAGE", "20")
+	t.Setenv("EKHOES_WS_RATE_CONNECTION", "0.001")
+	t.Setenv("EKHOES_WS_BURST_CONNECTION", "10")
+
+	wsConn := testConnection("s1", "u1", 1)
+	wsConn.ConnectionId = "c2"
+	t.Cleanup(func() { unsubscribeAll(wsConn) })
+
+	var out common.Message
+
+	// The first topic is paid by the message, checkRateLimit() isn't called here
+	if err := handleTopicMessage(wsConn, auth.User{Id: "u1"}, subscribeMessage(topicList("test:a", 11)...), &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := handleTopicMessage(wsConn, auth.User{Id: "u1"}, subscribeMessage(topicList("test:b", 2)...), &out)
+
+	if code := errorCode(err); code != common.ErrThrottled {
+		t.Errorf("error = %v, want code %q", err, common.ErrThrottled)
+	}
+}
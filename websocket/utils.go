@@ -1,28 +1,46 @@
 package websocket
 
 import (
-	"ekhoes-server/auth"
+	"ekhoes-server/config"
 	"ekhoes-server/utils"
+	"errors"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-type WebsocketConnection struct {
-	Conn         *websocket.Conn `json:"conn"`
-	ConnectionId string          `json:"connectionId"`
-	SessionId    string          `json:"sessionId"`
-	Name         string          `json:"name"`
-	Email        string          `json:"email"`
-	Created      time.Time       `json:"created"`
-}
-
 var (
 	connections = make(map[string]map[string]*WebsocketConnection)
+	userCounts  = make(map[string]int) // Connections per user id
+	total       int
+	draining    bool // No new connections, see Drain()
 	mu          sync.RWMutex
 )
 
+var (
+	TooManySessionConnections = errors.New("too many connections for this session")
+	TooManyUserConnections    = errors.New("too many connections for this user")
+	TooManyConnections        = errors.New("too many connections")
+	ServerShuttingDown        = errors.New("server shutting down")
+)
+
+type ConnectionLimits struct {
+	MaxPerSession int  `json:"maxPerSession"`
+	MaxPerUser    int  `json:"maxPerUser"`
+	MaxTotal      int  `json:"maxTotal"`
+	EvictOldest   bool `json:"evictOldest"`
+}
+
+func GetConnectionLimits() ConnectionLimits {
+	return ConnectionLimits{
+		MaxPerSession: config.WS_MaxConnectionsPerSession(),
+		MaxPerUser:    config.WS_MaxConnectionsPerUser(),
+		MaxTotal:      config.WS_MaxConnections(),
+		EvictOldest:   config.WS_EvictOldest(),
+	}
+}
+
 func GetConnections() []*WebsocketConnection {
 	mu.RLock()
 	defer mu.RUnlock()
@@ -42,19 +60,56 @@ func GetConnectionsCount() int32 {
 	mu.RLock()
 	defer mu.RUnlock()
 
-	var count int32
-
-	for _, sessionMap := range connections {
-		count += int32(len(sessionMap))
-	}
-
-	return count
+	return int32(total)
 }
 
-func AddConnection(wsConn *WebsocketConnection) {
+// AddConnection registers a connection, enforcing the limits returned by GetConnectionLimits()
+func AddConnection(wsConn *WebsocketConnection) error {
 	mu.Lock()
 	defer mu.Unlock()
 
+	if draining {
+		return ServerShuttingDown
+	}
+
+	limits := GetConnectionLimits()
+
+	// The oldest connection of a full session is replaced, but only once the new one is
+	// known to pass every other limit: a rejected connection must not cost another one
+	var evicted *WebsocketConnection
+
+	if limits.MaxPerSession > 0 && len(connections[wsConn.SessionId]) >= limits.MaxPerSession {
+		if !limits.EvictOldest {
+			return TooManySessionConnections
+		}
+
+		for _, c := range connections[wsConn.SessionId] {
+			if evicted == nil || c.Created.Before(evicted.Created) {
+				evicted = c
+			}
+		}
+	}
+
+	freed := 0
+	if evicted != nil {
+		freed = 1
+	}
+
+	if limits.MaxTotal > 0 && total-freed >= limits.MaxTotal {
+		return TooManyConnections
+	}
+
+	if limits.MaxPerUser > 0 && userCounts[wsConn.UserId]-freed >= limits.MaxPerUser {
+		return TooManyUserConnections
+	}
+
+	if evicted != nil {
+		utils.Log("Evicting connection %s of session %s\n", evicted.ConnectionId, evicted.SessionId)
+
+		removeConnection(evicted.SessionId, evicted.ConnectionId)
+		evicted.Close(websocket.ClosePolicyViolation /* 1008 */, "Replaced by a newer connection")
+	}
+
 	wsConn.ConnectionId = utils.ULID()
 	wsConn.Created = time.Now().UTC()
 
@@ -63,55 +118,102 @@ func AddConnection(wsConn *WebsocketConnection) {
 	}
 
 	connections[wsConn.SessionId][wsConn.ConnectionId] = wsConn
+	userCounts[wsConn.UserId]++
+	total++
+
+	return nil
 }
 
 func RemoveConnection(sessionId, connectionId string) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	if sessionMap, ok := connections[sessionId]; ok {
-		delete(sessionMap, connectionId)
+	removeConnection(sessionId, connectionId)
+}
 
-		if len(sessionMap) == 0 {
-			delete(connections, sessionId)
-		}
+// Must be called with mu held
+func removeConnection(sessionId, connectionId string) {
+	sessionMap, ok := connections[sessionId]
+	if !ok {
+		return
+	}
+
+	wsConn, ok := sessionMap[connectionId]
+	if !ok {
+		return
+	}
+
+	delete(sessionMap, connectionId)
+
+	if len(sessionMap) == 0 {
+		delete(connections, sessionId)
 	}
+
+	userCounts[wsConn.UserId]--
+
+	if userCounts[wsConn.UserId] <= 0 {
+		delete(userCounts, wsConn.UserId)
+	}
+
+	total--
+}
+
+func getUserConnectionsCount(userId string) int {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return userCounts[userId]
 }
 
-func GetWebsocketConnection(sessionId, connectionId string) *WebsocketConnection {
+// Snapshot of the connections matching filter, taken under the registry lock
+func findConnections(filter func(*WebsocketConnection) bool) []*WebsocketConnection {
 	mu.RLock()
 	defer mu.RUnlock()
 
-	if sessionMap, ok := connections[sessionId]; ok {
-		if conn, ok := sessionMap[connectionId]; ok {
-			return conn
+	var result []*WebsocketConnection
+
+	for _, sessionMap := range connections {
+		for _, conn := range sessionMap {
+			if filter == nil || filter(conn) {
+				result = append(result, conn)
+			}
 		}
 	}
 
-	return nil
+	return result
 }
 
 func onDisconnect(wsConn *WebsocketConnection) {
 	RemoveConnection(wsConn.SessionId, wsConn.ConnectionId)
-	wsConn.Conn.Close()
-	auth.SetSessionActive(wsConn.SessionId, false)
-}
+	unregisterConnection(wsConn)
+	unsubscribeAll(wsConn)
+	wsConn.stopExpiry()
+	wsConn.Close(websocket.CloseNormalClosure, "")
 
-func disconnect(wsConn *WebsocketConnection) {
-	_ = wsConn.Conn.WriteMessage(
-		websocket.CloseMessage,
-		websocket.FormatCloseMessage(
-			websocket.CloseServiceRestart,
-			"Connection closed server side",
-		),
-	)
-	onDisconnect(wsConn)
+	// The session goes idle if the client doesn't come back in time
+	releaseSessionBuffer(wsConn.SessionId)
+
+	if getUserConnectionsCount(wsConn.UserId) == 0 {
+		removeUserLimiter(wsConn.UserId)
+	}
 }
 
+// DisconnectAll closes every connection with 1012 and gives the writers the time to send the close frame
 func DisconnectAll() {
-	for _, sessionMap := range connections {
-		for _, conn := range sessionMap {
-			disconnect(conn)
+	list := findConnections(nil)
+
+	for _, conn := range list {
+		conn.Close(websocket.CloseServiceRestart, "Connection closed server side")
+	}
+
+	// Give writers the chance to send the close frame
+	timeout := time.After(writeWait)
+
+	for _, conn := range list {
+		select {
+		case <-conn.closed:
+		case <-timeout:
+			return
 		}
 	}
 }
@@ -0,0 +1,133 @@
+package websocket
+
+import (
+	"errors"
+	"testing"
+
+	"ekhoes-server/common"
+)
+
+// A connection without a socket, its queue is read by the test instead of writePump()
+func testConnection(sessionId string, userId string, queueSize int) *WebsocketConnection {
+	return &WebsocketConnection{
+		SessionId: sessionId,
+		UserId:    userId,
+		codec:     jsonCodec{},
+		limiter:   newConnLimiter(),
+		send:      make(chan common.Message, queueSize),
+		done:      make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+}
+
+// Empty the local registry when the test is over
+func resetConnections(t *testing.T) {
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		connections = make(map[string]map[string]*WebsocketConnection)
+		userCounts = make(map[string]int)
+		total = 0
+	})
+}
+
+func isClosing(wsConn *WebsocketConnection) bool {
+	select {
+	case <-wsConn.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestAddConnectionLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		evict    bool
+		existing [][2]string // Session and user of the connections already there
+		err      error
+		evicted  int // Index in existing of the connection replaced, -1 for none
+	}{
+		{"under the limits", false, [][2]string{{"s1", "u1"}}, nil, -1},
+		{"session full", false, [][2]string{{"s1", "u1"}, {"s1", "u1"}}, TooManySessionConnections, -1},
+		{"session full, oldest evicted", true, [][2]string{{"s1", "u1"}, {"s1", "u1"}}, nil, 0},
+		{"user full", false, [][2]string{{"s2", "u1"}, {"s3", "u1"}, {"s4", "u1"}}, TooManyUserConnections, -1},
+		{"session and user full, eviction makes room", true, [][2]string{{"s1", "u1"}, {"s1", "u1"}, {"s2", "u1"}}, nil, 0},
+		{"server full", false, [][2]string{{"s2", "u2"}, {"s3", "u3"}, {"s4", "u4"}, {"s5", "u5"}}, TooManyConnections, -1},
+		{"server full, eviction makes room", true, [][2]string{{"s1", "u1"}, {"s1", "u1"}, {"s3", "u3"}, {"s4", "u4"}}, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetConnections(t)
+
+			t.Setenv("EKHOES_WS_MAX_PER_SESSION", "2")
+			t.Setenv("EKHOES_WS_MAX_PER_USER", "3")
+			t.Setenv("EKHOES_WS_MAX_TOTAL", "4")
+			if tt.evict {
+				t.Setenv("EKHOES_WS_EVICT_OLDEST", "true")
+			} else {
+				t.Setenv("EKHOES_WS_EVICT_OLDEST", "")
+			}
+
+			existing := addConnections(t, tt.existing)
+
+			err := AddConnection(testConnection("s1", "u1", 1))
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+
+			for i, wsConn := range existing {
+				if closing := isClosing(wsConn); closing != (i == tt.evicted) {
+					t.Errorf("connection %d closing = %v", i, closing)
+				}
+			}
+		})
+	}
+}
+
+// A rejected connection must not replace anything, e.g. when the user is over a limit lowered meanwhile
+func TestAddConnectionRejectedDoesntEvict(t *testing.T) {
+	resetConnections(t)
+
+	t.Setenv("EKHOES_WS_MAX_PER_SESSION", "2")
+	t.Setenv("EKHOES_WS_MAX_PER_USER", "4")
+	t.Setenv("EKHOES_WS_MAX_TOTAL", "10")
+	t.Setenv("EKHOES_WS_EVICT_OLDEST", "true")
+
+	existing := addConnections(t, [][2]string{{"s1", "u1"}, {"s1", "u1"}, {"s2", "u1"}, {"s3", "u1"}})
+
+	t.Setenv("EKHOES_WS_MAX_PER_USER", "3")
+
+	if err := AddConnection(testConnection("s1", "u1", 1)); !errors.Is(err, TooManyUserConnections) {
+		t.Fatalf("error = %v, want %v", err, TooManyUserConnections)
+	}
+
+	for i, wsConn := range existing {
+		if isClosing(wsConn) {
+			t.Errorf("connection %d closed", i)
+		}
+	}
+
+	if n := GetConnectionsCount(); n != 4 {
+		t.Errorf("connections = %d, want 4", n)
+	}
+}
+
+func addConnections(t *testing.T, list [][2]string) []*WebsocketConnection {
+	t.Helper()
+
+	var result []*WebsocketConnection
+
+	for _, e := range list {
+		wsConn := testConnection(e[0], e[1], 1)
+		if err := AddConnection(wsConn); err != nil {
+			t.Fatalf("setup: %v", err)
+		}
+		result = append(result, wsConn)
+	}
+
+	return result
+}